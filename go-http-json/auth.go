@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// role is what an API key is allowed to do.
+type role int
+
+const (
+	roleRead role = iota
+	roleAdmin
+)
+
+// roleNames maps the names used in PEOPLE_API_KEYS and key files to roles.
+var roleNames = map[string]role{
+	"read":  roleRead,
+	"admin": roleAdmin,
+}
+
+// OAuth-style scopes checked by the handlers. JWTs carry them directly;
+// API-key roles are expanded into them by role.scopes.
+const (
+	scopeRead  = "people:read"
+	scopeWrite = "people:write"
+	scopeAdmin = "people:admin"
+)
+
+// scopes returns the scopes granted to an API key with role r.
+func (r role) scopes() []string {
+	switch r {
+	case roleRead:
+		return []string{scopeRead}
+	case roleAdmin:
+		return []string{scopeRead, scopeWrite, scopeAdmin}
+	}
+	return nil
+}
+
+// publicPaths never require credentials.
+var publicPaths = map[string]bool{
+	"/status":       true,
+	"/metrics":      true,
+	"/livez":        true,
+	"/readyz":       true,
+	"/openapi.json": true,
+}
+
+// principal is the authenticated caller of a request: an API key or the
+// subject of a JWT.
+type principal struct {
+	ID     string
+	Scopes []string
+}
+
+// has reports whether p was granted scope.
+func (p principal) has(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+// principalKey is the context key for the principal.
+type principalKey struct{}
+
+// principalFrom returns the principal stored by withAuth, if any.
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// apiKey is a configured key. Only its SHA-256 hash is kept in memory.
+type apiKey struct {
+	id   string
+	hash [sha256.Size]byte
+	role role
+}
+
+// apiKeySet holds every configured key.
+type apiKeySet struct {
+	keys []apiKey
+}
+
+// loadAPIKeys reads keys from spec (PEOPLE_API_KEYS) and, if path is set,
+// from a key file. Both hold "role:key" entries, separated by commas or
+// newlines; blank lines and lines starting with # are ignored.
+func loadAPIKeys(spec, path string) (*apiKeySet, error) {
+	set := &apiKeySet{}
+	err := set.parse(spec, "PEOPLE_API_KEYS")
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = set.parse(string(data), path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// parse adds the entries in text; source names it in error messages.
+func (s *apiKeySet) parse(text, source string) error {
+	lines := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' })
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, key, ok := strings.Cut(line, ":")
+		r, known := roleNames[strings.TrimSpace(name)]
+		key = strings.TrimSpace(key)
+		switch {
+		case !ok || key == "":
+			return fmt.Errorf("%s: entry %d: want role:key", source, i+1)
+		case !known:
+			return fmt.Errorf("%s: entry %d: unknown role %q; use read or admin", source, i+1, name)
+		}
+
+		hash := sha256.Sum256([]byte(key))
+		s.keys = append(s.keys, apiKey{
+			// The hash prefix identifies the key in logs without revealing it.
+			id:   "key-" + hex.EncodeToString(hash[:4]),
+			hash: hash,
+			role: r,
+		})
+	}
+	return nil
+}
+
+// enabled reports whether any key is configured.
+func (s *apiKeySet) enabled() bool {
+	return s != nil && len(s.keys) > 0
+}
+
+// authEnabled reports whether requests must carry credentials, which is the
+// case as soon as API keys or a JWKS file are configured.
+func (s *server) authEnabled() bool {
+	return s.apiKeys.enabled() || s.jwt != nil
+}
+
+// lookup returns the principal for token. It hashes the token and compares
+// it against every key in constant time, without stopping at a match, so
+// the response time does not reveal which key or how much of it matched.
+func (s *apiKeySet) lookup(token string) (principal, bool) {
+	hash := sha256.Sum256([]byte(token))
+	var found principal
+	match := 0
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			found = principal{ID: k.id, Scopes: k.role.scopes()}
+			match = 1
+		}
+	}
+	return found, match == 1
+}
+
+// requiredScope returns the scope needed for a request: the admin API needs
+// people:admin, other reads need people:read, and anything that changes
+// data needs people:write. /rpc only needs people:read to get in; each
+// call is then checked against the scope of its method.
+func requiredScope(r *http.Request) string {
+	if isAdminPath(r.URL.Path) {
+		return scopeAdmin
+	}
+	if r.URL.Path == "/rpc" {
+		return scopeRead
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead
+	default:
+		return scopeWrite
+	}
+}
+
+// withAuth requires an "Authorization: Bearer" header on every path except
+// publicPaths, and stores the caller in the request context. The credential
+// is verified as a JWT if it has three dot-separated parts and a JWKS file
+// is configured, and looked up as an API key otherwise. Bad credentials get
+// 401; a caller without the scope for the method gets 403. When neither
+// keys nor a JWKS file are configured, auth is off and requests pass
+// through, except to the admin API, which answers 403: anyone could
+// otherwise subscribe a webhook to every change, or make the server call
+// any URL.
+func (s *server) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled() && isAdminPath(r.URL.Path) {
+			writeProblem(w, r, http.StatusForbidden, codeForbidden, "the admin API is disabled until API keys or a JWKS file are configured")
+			return
+		}
+		if !s.authEnabled() || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="people"`)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "send an API key or JWT as Authorization: Bearer <token>")
+			return
+		}
+
+		var p principal
+		if s.jwt != nil && looksLikeJWT(token) {
+			claims, err := s.jwt.verify(token, time.Now())
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="people", error="invalid_token"`)
+				writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, err.Error())
+				return
+			}
+			p = principal{ID: "jwt:" + claims.Subject, Scopes: claims.scopes()}
+		} else {
+			p, ok = s.apiKeys.lookup(token)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="people", error="invalid_token"`)
+				writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "API key is not valid")
+				return
+			}
+		}
+
+		need := requiredScope(r)
+		if !p.has(need) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="people", error="insufficient_scope", scope=%q`, need))
+			writeProblem(w, r, http.StatusForbidden, codeForbidden, fmt.Sprintf("%s %s requires the %s scope", r.Method, r.URL.Path, need))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey{}, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// bearerToken returns the credentials of an "Authorization: Bearer" header.
+// The scheme is case-insensitive (RFC 7235).
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
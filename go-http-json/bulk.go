@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+)
+
+// Limits for POST /people/bulk.
+const (
+	maxBulkBodyBytes = 64 << 20 // 64 MiB
+	maxBulkLineBytes = 64 << 10 // 64 KiB per NDJSON line
+	bulkChunkSize    = 500      // people per store write in best-effort mode
+)
+
+// Bulk import modes selected with ?mode=.
+const (
+	bulkModeAtomic     = "atomic"
+	bulkModeBestEffort = "best_effort"
+)
+
+// Per-item statuses in a bulk report.
+const (
+	bulkStatusCreated = "created"
+	bulkStatusInvalid = "invalid"
+	bulkStatusSkipped = "skipped" // valid, but not created because the atomic batch failed
+	bulkStatusFailed  = "failed"  // valid, but the store write failed
+)
+
+// bulkItemResult is the outcome for one input item. Line is the 1-based
+// line number for NDJSON input and the 1-based element position for a JSON array.
+type bulkItemResult struct {
+	Line   int          `json:"line" validate:"required"`
+	Status string       `json:"status" validate:"required,enum=created|invalid|skipped|failed"`
+	ID     int          `json:"id,omitempty"`
+	Code   string       `json:"code,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+// bulkReport is the response body of POST /people/bulk.
+type bulkReport struct {
+	Mode    string           `json:"mode" validate:"required,enum=atomic|best_effort"`
+	Total   int              `json:"total" validate:"required"`
+	Created int              `json:"created" validate:"required"`
+	Failed  int              `json:"failed" validate:"required"`
+	Results []bulkItemResult `json:"results" validate:"required"`
+}
+
+// bulkImport collects results while the request body is streamed.
+// Valid people wait in pending until they are flushed to the store.
+type bulkImport struct {
+	s       *server
+	r       *http.Request
+	version apiVersion
+	report  bulkReport
+	pending []Person
+	slots   []int // index into report.Results for each pending person
+}
+
+// add records one decoded item. decodeErr is the error from decodeStrict or
+// the array decoder, if any; req is only used when it is nil.
+func (b *bulkImport) add(line int, req personCreate, decodeErr error) {
+	b.report.Total++
+	result := bulkItemResult{Line: line}
+
+	var reqErr *requestError
+	if errors.As(decodeErr, &reqErr) {
+		result.Status = bulkStatusInvalid
+		result.Code = reqErr.code
+		result.Detail = reqErr.detail
+		result.Errors = reqErr.fields
+	} else if errs := req.validate(); len(errs) > 0 {
+		result.Status = bulkStatusInvalid
+		result.Code = codeValidation
+		result.Errors = errs
+	}
+
+	b.report.Results = append(b.report.Results, result)
+	if result.Status == bulkStatusInvalid {
+		b.report.Failed++
+		return
+	}
+
+	b.pending = append(b.pending, req.person())
+	b.slots = append(b.slots, len(b.report.Results)-1)
+
+	if b.report.Mode == bulkModeBestEffort && len(b.pending) >= bulkChunkSize {
+		b.flush()
+	}
+}
+
+// flush writes the pending people with one CreateMany call and fills in
+// their results.
+func (b *bulkImport) flush() {
+	if len(b.pending) == 0 {
+		return
+	}
+
+	created, err := b.s.store.CreateMany(b.r.Context(), b.pending)
+	for i, slot := range b.slots {
+		result := &b.report.Results[slot]
+		if err != nil {
+			result.Status = bulkStatusFailed
+			result.Code = codeInternal
+			b.report.Failed++
+			continue
+		}
+		result.Status = bulkStatusCreated
+		result.ID = created[i].ID
+		b.report.Created++
+	}
+	if err != nil {
+		slog.ErrorContext(b.r.Context(), "bulk import store error", "err", err)
+	}
+
+	b.pending = b.pending[:0]
+	b.slots = b.slots[:0]
+}
+
+// skipPending marks every pending person as skipped without storing it.
+func (b *bulkImport) skipPending() {
+	for _, slot := range b.slots {
+		b.report.Results[slot].Status = bulkStatusSkipped
+	}
+	b.pending = nil
+	b.slots = nil
+}
+
+// bulkCreatePeopleHandler imports many people from one request. The body is
+// either newline-delimited JSON (application/x-ndjson) or a JSON array
+// (application/json) of create requests in the request's API version, and
+// is streamed item by item through the same validation as
+// createPersonHandler.
+//
+// With ?mode=atomic (the default) nothing is created unless every item is
+// valid. With ?mode=best_effort valid items are created in chunks and invalid
+// ones are reported. Either way the response lists a result per item.
+func (s *server) bulkCreatePeopleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = bulkModeAtomic
+	}
+	if mode != bulkModeAtomic && mode != bulkModeBestEffort {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "mode must be atomic or best_effort")
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-ndjson" && mediaType != "application/json" {
+		writeProblem(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Content-Type must be application/x-ndjson or application/json")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBodyBytes)
+	b := &bulkImport{s: s, r: r, version: apiVersionFrom(r.Context()), report: bulkReport{Mode: mode, Results: []bulkItemResult{}}}
+
+	if mediaType == "application/x-ndjson" {
+		b.readNDJSON(r.Body)
+	} else {
+		err := b.readArray(r.Body)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	switch {
+	case mode == bulkModeAtomic && b.report.Failed > 0:
+		b.skipPending()
+		status = http.StatusUnprocessableEntity
+	case mode == bulkModeAtomic:
+		b.flush()
+		status = http.StatusCreated
+	default:
+		b.flush()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(b.report)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error encoding bulk report", "err", err)
+	}
+}
+
+// readNDJSON decodes one person per non-blank line. Lines longer than
+// maxBulkLineBytes are reported as invalid and skipped. A read error, such
+// as exceeding maxBulkBodyBytes, is reported on the line where it happened
+// and ends the import.
+func (b *bulkImport) readNDJSON(body io.Reader) {
+	br := bufio.NewReaderSize(body, maxBulkLineBytes)
+
+	for line := 1; ; line++ {
+		data, tooLong, err := readLine(br)
+		if err != nil && !errors.Is(err, io.EOF) {
+			b.add(line, nil, jsonDecodeError(err))
+			return
+		}
+
+		switch {
+		case tooLong:
+			b.add(line, nil, &requestError{
+				code:   codeBodyTooLarge,
+				detail: "line exceeds the maximum line length",
+			})
+		case len(bytes.TrimSpace(data)) > 0:
+			req := newPersonCreate(b.version)
+			decodeErr := decodeStrict(bytes.NewReader(data), req)
+			b.add(line, req, decodeErr)
+		}
+
+		if errors.Is(err, io.EOF) {
+			return
+		}
+	}
+}
+
+// readLine returns the next line without its newline. If the line does not
+// fit in br's buffer, the rest of it is discarded and tooLong is set.
+func readLine(br *bufio.Reader) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := br.ReadSlice('\n')
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			tooLong = true
+			continue
+		case tooLong:
+			return nil, true, err
+		default:
+			return bytes.TrimSuffix(chunk, []byte("\n")), false, err
+		}
+	}
+}
+
+// readArray decodes the elements of a top-level JSON array one at a time.
+// Type errors and unknown fields only invalidate the element they occur in.
+// A syntax error is reported on the element where it happened and ends the
+// import, since the rest of the array cannot be located. The returned error
+// is only set when the body is not an array at all.
+func (b *bulkImport) readArray(body io.Reader) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return jsonDecodeError(err)
+	}
+	if tok != json.Delim('[') {
+		return &requestError{status: http.StatusBadRequest, code: codeInvalidJSON, detail: "request body must be a JSON array"}
+	}
+
+	item := 1
+	for ; dec.More(); item++ {
+		req := newPersonCreate(b.version)
+		err := dec.Decode(req)
+		if err == nil {
+			b.add(item, req, nil)
+			continue
+		}
+
+		b.add(item, req, jsonDecodeError(err))
+		var syntaxErr *json.SyntaxError
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &syntaxErr) || errors.As(err, &maxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+	}
+
+	_, err = dec.Token()
+	if err != nil {
+		b.add(item, nil, jsonDecodeError(err))
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// config holds every setting of the server. Each one can be set with a flag
+// or, when the flag is not given, with the PEOPLE_* environment variable
+// shown in the flag usage. APIKeys is the exception: it is read only from
+// PEOPLE_API_KEYS, so secrets never show up in the process list.
+type config struct {
+	Addr               string
+	DataDir            string
+	ReadTimeout        time.Duration
+	ReadHeaderTimeout  time.Duration
+	WriteTimeout       time.Duration
+	IdleTimeout        time.Duration
+	MaxHeaderBytes     int
+	ShutdownTimeout    time.Duration
+	ShutdownDelay      time.Duration
+	MinFreeDisk        int
+	IdempotencyTTL     time.Duration
+	ReadRate           float64
+	ReadBurst          int
+	WriteRate          float64
+	WriteBurst         int
+	TrustProxy         bool
+	APIKeys            string
+	APIKeyFile         string
+	JWKSFile           string
+	JWTIssuer          string
+	JWTAudience        string
+	JWTLeeway          time.Duration
+	EventsBuffer       int
+	EventsHeartbeat    time.Duration
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	WebhookMaxBackoff  time.Duration
+	WebhookTimeout     time.Duration
+	PurgeRetention     time.Duration
+	PurgeInterval      time.Duration
+	V1Sunset           time.Time
+
+	// DumpOpenAPI is not a server setting: when set, main writes the
+	// OpenAPI document to this path ("-" for stdout) and exits.
+	DumpOpenAPI string
+}
+
+// loadConfig builds a config from defaults, then environment variables,
+// then command-line flags, so a flag always overrides the environment.
+func loadConfig(args []string) (config, error) {
+	env := envReader{}
+	cfg := config{
+		Addr:               env.string("PEOPLE_ADDR", ":8080"),
+		DataDir:            env.string("PEOPLE_DATA_DIR", ""),
+		ReadTimeout:        env.duration("PEOPLE_READ_TIMEOUT", 15*time.Second),
+		ReadHeaderTimeout:  env.duration("PEOPLE_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:       env.duration("PEOPLE_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:        env.duration("PEOPLE_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:     env.int("PEOPLE_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+		ShutdownTimeout:    env.duration("PEOPLE_SHUTDOWN_TIMEOUT", 15*time.Second),
+		ShutdownDelay:      env.duration("PEOPLE_SHUTDOWN_DELAY", 0),
+		MinFreeDisk:        env.int("PEOPLE_MIN_FREE_DISK", 64<<20),
+		IdempotencyTTL:     env.duration("PEOPLE_IDEMPOTENCY_TTL", 24*time.Hour),
+		ReadRate:           env.float("PEOPLE_RATE_READ", 20),
+		ReadBurst:          env.int("PEOPLE_RATE_READ_BURST", 40),
+		WriteRate:          env.float("PEOPLE_RATE_WRITE", 5),
+		WriteBurst:         env.int("PEOPLE_RATE_WRITE_BURST", 10),
+		TrustProxy:         env.bool("PEOPLE_TRUST_PROXY", false),
+		APIKeys:            env.string("PEOPLE_API_KEYS", ""),
+		APIKeyFile:         env.string("PEOPLE_API_KEY_FILE", ""),
+		JWKSFile:           env.string("PEOPLE_JWKS_FILE", ""),
+		JWTIssuer:          env.string("PEOPLE_JWT_ISSUER", ""),
+		JWTAudience:        env.string("PEOPLE_JWT_AUDIENCE", ""),
+		JWTLeeway:          env.duration("PEOPLE_JWT_LEEWAY", 30*time.Second),
+		EventsBuffer:       env.int("PEOPLE_EVENTS_BUFFER", 1000),
+		EventsHeartbeat:    env.duration("PEOPLE_EVENTS_HEARTBEAT", 15*time.Second),
+		WebhookMaxAttempts: env.int("PEOPLE_WEBHOOK_MAX_ATTEMPTS", 8),
+		WebhookBackoff:     env.duration("PEOPLE_WEBHOOK_BACKOFF", time.Second),
+		WebhookMaxBackoff:  env.duration("PEOPLE_WEBHOOK_MAX_BACKOFF", time.Hour),
+		WebhookTimeout:     env.duration("PEOPLE_WEBHOOK_TIMEOUT", 10*time.Second),
+		PurgeRetention:     env.duration("PEOPLE_PURGE_RETENTION", 30*24*time.Hour),
+		PurgeInterval:      env.duration("PEOPLE_PURGE_INTERVAL", time.Hour),
+		V1Sunset:           env.time("PEOPLE_V1_SUNSET", time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)),
+	}
+	if env.err != nil {
+		return cfg, env.err
+	}
+
+	fs := flag.NewFlagSet("go-http-json", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "listen address (PEOPLE_ADDR)")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory for the people.json snapshot; empty keeps data in memory only (PEOPLE_DATA_DIR)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "maximum time to read a whole request (PEOPLE_READ_TIMEOUT)")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", cfg.ReadHeaderTimeout, "maximum time to read request headers (PEOPLE_READ_HEADER_TIMEOUT)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "maximum time to write a response (PEOPLE_WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "how long keep-alive connections may stay idle (PEOPLE_IDLE_TIMEOUT)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", cfg.MaxHeaderBytes, "maximum size of request headers in bytes (PEOPLE_MAX_HEADER_BYTES)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "how long to drain in-flight requests on SIGINT/SIGTERM (PEOPLE_SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&cfg.ShutdownDelay, "shutdown-delay", cfg.ShutdownDelay, "how long /readyz fails before the listener closes on shutdown (PEOPLE_SHUTDOWN_DELAY)")
+	fs.IntVar(&cfg.MinFreeDisk, "min-free-disk", cfg.MinFreeDisk, "bytes that must be free in -data-dir for /readyz to pass (PEOPLE_MIN_FREE_DISK)")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", cfg.IdempotencyTTL, "how long responses to POSTs with an Idempotency-Key are replayed (PEOPLE_IDEMPOTENCY_TTL)")
+	fs.Float64Var(&cfg.ReadRate, "rate-read", cfg.ReadRate, "read requests per second per client; 0 disables (PEOPLE_RATE_READ)")
+	fs.IntVar(&cfg.ReadBurst, "rate-read-burst", cfg.ReadBurst, "read requests a client may burst (PEOPLE_RATE_READ_BURST)")
+	fs.Float64Var(&cfg.WriteRate, "rate-write", cfg.WriteRate, "write requests per second per client; 0 disables (PEOPLE_RATE_WRITE)")
+	fs.IntVar(&cfg.WriteBurst, "rate-write-burst", cfg.WriteBurst, "write requests a client may burst (PEOPLE_RATE_WRITE_BURST)")
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", cfg.TrustProxy, "identify clients by the last X-Forwarded-For entry; only enable behind a proxy that appends it (PEOPLE_TRUST_PROXY)")
+	fs.StringVar(&cfg.APIKeyFile, "api-key-file", cfg.APIKeyFile, "file of role:key lines (read or admin) added to PEOPLE_API_KEYS; no keys disables auth (PEOPLE_API_KEY_FILE)")
+	fs.StringVar(&cfg.JWKSFile, "jwks-file", cfg.JWKSFile, "JSON Web Key Set used to verify HS256/RS256 bearer JWTs; empty disables JWTs (PEOPLE_JWKS_FILE)")
+	fs.StringVar(&cfg.JWTIssuer, "jwt-issuer", cfg.JWTIssuer, "required iss claim; empty accepts any (PEOPLE_JWT_ISSUER)")
+	fs.StringVar(&cfg.JWTAudience, "jwt-audience", cfg.JWTAudience, "required aud entry; empty accepts any (PEOPLE_JWT_AUDIENCE)")
+	fs.DurationVar(&cfg.JWTLeeway, "jwt-leeway", cfg.JWTLeeway, "clock skew allowed when checking exp and nbf (PEOPLE_JWT_LEEWAY)")
+	fs.IntVar(&cfg.EventsBuffer, "events-buffer", cfg.EventsBuffer, "change events kept for clients resuming /people/events with Last-Event-ID (PEOPLE_EVENTS_BUFFER)")
+	fs.DurationVar(&cfg.EventsHeartbeat, "events-heartbeat", cfg.EventsHeartbeat, "interval of keep-alive comments on idle /people/events streams (PEOPLE_EVENTS_HEARTBEAT)")
+	fs.IntVar(&cfg.WebhookMaxAttempts, "webhook-max-attempts", cfg.WebhookMaxAttempts, "delivery attempts before a webhook event is dead-lettered (PEOPLE_WEBHOOK_MAX_ATTEMPTS)")
+	fs.DurationVar(&cfg.WebhookBackoff, "webhook-backoff", cfg.WebhookBackoff, "delay before the first webhook retry; doubles on each attempt (PEOPLE_WEBHOOK_BACKOFF)")
+	fs.DurationVar(&cfg.WebhookMaxBackoff, "webhook-max-backoff", cfg.WebhookMaxBackoff, "longest delay between webhook retries (PEOPLE_WEBHOOK_MAX_BACKOFF)")
+	fs.DurationVar(&cfg.WebhookTimeout, "webhook-timeout", cfg.WebhookTimeout, "timeout of one webhook delivery attempt (PEOPLE_WEBHOOK_TIMEOUT)")
+	fs.DurationVar(&cfg.PurgeRetention, "purge-retention", cfg.PurgeRetention, "how long deleted people can be restored before they are purged (PEOPLE_PURGE_RETENTION)")
+	fs.DurationVar(&cfg.PurgeInterval, "purge-interval", cfg.PurgeInterval, "how often to purge expired deleted people; 0 disables purging (PEOPLE_PURGE_INTERVAL)")
+	fs.TextVar(&cfg.V1Sunset, "v1-sunset", cfg.V1Sunset, "RFC 3339 time sent in the Sunset header of /v1 responses (PEOPLE_V1_SUNSET)")
+	fs.StringVar(&cfg.DumpOpenAPI, "dump-openapi", "", `write the OpenAPI document to this file ("-" for stdout) and exit`)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if cfg.EventsHeartbeat <= 0 {
+		return cfg, fmt.Errorf("-events-heartbeat must be positive, got %s", cfg.EventsHeartbeat)
+	}
+	if cfg.PurgeRetention < 0 || cfg.PurgeInterval < 0 {
+		return cfg, fmt.Errorf("-purge-retention and -purge-interval must not be negative")
+	}
+	if cfg.WebhookBackoff <= 0 || cfg.WebhookMaxBackoff < cfg.WebhookBackoff {
+		return cfg, fmt.Errorf("-webhook-backoff must be positive and at most -webhook-max-backoff")
+	}
+	return cfg, nil
+}
+
+// envReader reads typed environment variables and keeps the first parse
+// error, so loadConfig can check once after reading them all.
+type envReader struct {
+	err error
+}
+
+func (e *envReader) string(name, def string) string {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	return v
+}
+
+func (e *envReader) duration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(name, v, err)
+		return def
+	}
+	return d
+}
+
+func (e *envReader) time(name string, def time.Time) time.Time {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		e.fail(name, v, err)
+		return def
+	}
+	return t
+}
+
+func (e *envReader) int(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(name, v, err)
+		return def
+	}
+	return n
+}
+
+func (e *envReader) float(name string, def float64) float64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail(name, v, err)
+		return def
+	}
+	return f
+}
+
+func (e *envReader) bool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(name, v, err)
+		return def
+	}
+	return b
+}
+
+func (e *envReader) fail(name, value string, err error) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid %s=%q: %w", name, value, err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// freeDiskSpace is not implemented here; the disk health check passes.
+func freeDiskSpace(dir string) (uint64, error) {
+	return 0, errDiskSpaceUnsupported
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// errPreconditionFailed is returned from store callbacks when the If-Match
+// header does not match the stored version.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// personETag returns the strong entity tag for the current version of p.
+func personETag(p Person) string {
+	return `"v` + strconv.Itoa(p.Version) + `"`
+}
+
+// projectedETag returns the entity tag of p as rendered by pr. A response
+// shaped by ?fields= or ?include= is a different representation from the
+// full one, so its tag adds a hash of the projection. The order of the names
+// does not change the body, so it does not change the hash either.
+func projectedETag(pr projection, p Person) string {
+	if pr.full() {
+		return personETag(p)
+	}
+	names := func(list []string) string {
+		return strings.Join(slices.Compact(slices.Sorted(slices.Values(list))), ",")
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d;%s;%s", pr.version, names(pr.fields), names(pr.include))
+	return fmt.Sprintf(`"v%d-%08x"`, p.Version, h.Sum32())
+}
+
+// checkIfMatch enforces the If-Match header against p. It is meant to run
+// inside a store callback so the comparison and the write are atomic.
+func checkIfMatch(r *http.Request, p Person) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+	if !etagListContains(header, personETag(p), false) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// notModified reports whether the If-None-Match header matches etag, in
+// which case a GET should answer 304.
+func notModified(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	return header != "" && etagListContains(header, etag, true)
+}
+
+// etagListContains reports whether etag appears in a comma-separated list of
+// entity tags, or the list is "*". If-Match uses strong comparison, so a weak
+// tag (W/"...") only matches when weak is set, as for If-None-Match.
+func etagListContains(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
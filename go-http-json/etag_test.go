@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProjectedETag(t *testing.T) {
+	h := newTestServer(t, testConfig(t)).handler()
+	w := serve(t, h, http.MethodPost, "/v2/people", `{"name":"Ada Lovelace","age":36}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create person: %d %s", w.Code, w.Body)
+	}
+	path := w.Header().Get("Location")
+
+	// get fetches path with If-None-Match set to inm, if any.
+	get := func(path, inm string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	full := get(path, "").Header().Get("ETag")
+	if full != `"v1"` {
+		t.Fatalf("full ETag = %s, want \"v1\"", full)
+	}
+	projected := get(path+"?fields=id,name&include=initials", "").Header().Get("ETag")
+
+	etags := []struct {
+		name, query string
+		same        bool // as projected
+	}{
+		{"same projection", "?fields=id,name&include=initials", true},
+		{"reordered projection", "?include=initials&fields=name,id", true},
+		{"repeated field", "?fields=id,name,name&include=initials", true},
+		{"fewer fields", "?fields=id", false},
+		{"no computed field", "?fields=id,name", false},
+		{"full person", "", false},
+	}
+	for _, tt := range etags {
+		t.Run(tt.name, func(t *testing.T) {
+			got := get(path+tt.query, "").Header().Get("ETag")
+			if got == "" || (got == projected) != tt.same {
+				t.Fatalf("ETag = %s, projected ETag %s; want same = %v", got, projected, tt.same)
+			}
+			if tt.query != "" && got == full {
+				t.Fatalf("projected ETag %s equals the full ETag", got)
+			}
+		})
+	}
+
+	conditional := []struct {
+		query, inm string
+		want       int
+	}{
+		{"", full, http.StatusNotModified},
+		{"", projected, http.StatusOK},
+		{"?fields=id,name&include=initials", projected, http.StatusNotModified},
+		{"?fields=id,name&include=initials", full, http.StatusOK},
+		{"?fields=id", projected, http.StatusOK},
+	}
+	for _, tt := range conditional {
+		if got := get(path+tt.query, tt.inm).Code; got != tt.want {
+			t.Errorf("GET %s with If-None-Match %s = %d, want %d", tt.query, tt.inm, got, tt.want)
+		}
+	}
+
+	// A change to the person changes every ETag derived from it.
+	w = serve(t, h, http.MethodPatch, path, `{"age":37}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update person: %d %s", w.Code, w.Body)
+	}
+	if got := get(path+"?fields=id,name&include=initials", projected).Code; got != http.StatusOK {
+		t.Errorf("projected GET after an update with the old ETag = %d, want 200", got)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of the change feed.
+const (
+	subscriberBuffer = 256              // events queued per subscriber before it is cut off
+	sseWriteTimeout  = 10 * time.Second // per write; a client that cannot keep up is dropped
+	sseRetry         = 3 * time.Second  // reconnect delay suggested to EventSource clients
+)
+
+// subscriber is one open /people/events stream. gone is closed when the
+// broker drops it, either because it fell behind or on shutdown.
+type subscriber struct {
+	events chan changeEvent
+	gone   chan struct{}
+}
+
+// eventBroker is a changeSink that fans events out to SSE subscribers and
+// keeps the most recent ones in a ring so reconnecting clients can catch up.
+type eventBroker struct {
+	mu     sync.Mutex
+	ring   []changeEvent // oldest first once full; see ringEvents
+	next   int           // where the next event goes in ring
+	full   bool
+	last   uint64 // ID of the newest event, 0 before the first
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+// newEventBroker returns a broker that remembers up to size events.
+func newEventBroker(size int) *eventBroker {
+	return &eventBroker{
+		ring: make([]changeEvent, max(size, 1)),
+		subs: make(map[*subscriber]struct{}),
+	}
+}
+
+// publish stores ev and queues it for every subscriber. A subscriber whose
+// queue is full is dropped instead of blocking the writer that made the
+// change.
+func (b *eventBroker) publish(ev changeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ring[b.next] = ev
+	b.next = (b.next + 1) % len(b.ring)
+	if b.next == 0 {
+		b.full = true
+	}
+	b.last = ev.ID
+
+	for sub := range b.subs {
+		select {
+		case sub.events <- ev:
+		default:
+			b.drop(sub)
+		}
+	}
+}
+
+// ringEvents returns the stored events, oldest first. The caller must hold b.mu.
+func (b *eventBroker) ringEvents() []changeEvent {
+	if !b.full {
+		return b.ring[:b.next]
+	}
+	return append(append([]changeEvent(nil), b.ring[b.next:]...), b.ring[:b.next]...)
+}
+
+// subscribe registers a new subscriber. With resume set, missed holds the
+// stored events after lastID and complete reports whether they are all of
+// them; it is false when lastID is older than the ring or unknown. The
+// subscriber is registered under the same lock, so no event falls between
+// the backlog and the live stream.
+func (b *eventBroker) subscribe(lastID uint64, resume bool) (sub *subscriber, missed []changeEvent, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &subscriber{
+		events: make(chan changeEvent, subscriberBuffer),
+		gone:   make(chan struct{}),
+	}
+	if b.closed {
+		close(sub.gone)
+		return sub, nil, true
+	}
+	b.subs[sub] = struct{}{}
+
+	if !resume {
+		return sub, nil, true
+	}
+	stored := b.ringEvents()
+	for _, ev := range stored {
+		if ev.ID > lastID {
+			missed = append(missed, ev)
+		}
+	}
+	switch {
+	case lastID > b.last:
+		complete = false
+	case len(stored) == 0:
+		complete = lastID == b.last
+	default:
+		complete = lastID+1 >= stored[0].ID
+	}
+	return sub, missed, complete
+}
+
+// unsubscribe removes sub if it is still registered.
+func (b *eventBroker) unsubscribe(sub *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[sub]; ok {
+		b.drop(sub)
+	}
+}
+
+// drop removes sub and closes gone. The caller must hold b.mu.
+func (b *eventBroker) drop(sub *subscriber) {
+	delete(b.subs, sub)
+	close(sub.gone)
+}
+
+// close ends every stream, so http.Server.Shutdown does not wait for them
+// until its timeout. It is registered with RegisterOnShutdown.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		b.drop(sub)
+	}
+}
+
+// peopleEventsHandler streams change events as Server-Sent Events. A
+// client reconnecting with Last-Event-ID first gets the events it missed;
+// if some are no longer in the ring it gets a "reset" event instead and
+// should reload GET /people. A comment line is sent as a heartbeat when
+// nothing else was written for cfg.EventsHeartbeat.
+func (s *server) peopleEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	var lastID uint64
+	resume := false
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, "Last-Event-ID must be an event ID from this stream")
+			return
+		}
+		lastID, resume = id, true
+	}
+
+	pr, err := parseProjection(r.URL.Query(), apiVersionFrom(r.Context()))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	sub, missed, complete := s.events.subscribe(lastID, resume)
+	defer s.events.unsubscribe(sub)
+
+	h := w.Header()
+	h.Set("Content-Type", mediaEventStream)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // tell nginx not to buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	// write sends one chunk with its own deadline, replacing the server's
+	// WriteTimeout, which would otherwise end every stream after 30s.
+	write := func(chunk string) bool {
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		_, err := w.Write([]byte(chunk))
+		if err == nil {
+			err = rc.Flush()
+		}
+		return err == nil
+	}
+
+	if !write(fmt.Sprintf("retry: %d\n\n", sseRetry.Milliseconds())) {
+		return
+	}
+	if !complete {
+		if !write("event: reset\ndata: {}\n\n") {
+			return
+		}
+		missed = nil
+	}
+	// send writes one event. An event that cannot be encoded is logged and
+	// skipped rather than sent as a broken data line.
+	send := func(ev changeEvent) bool {
+		msg, err := formatSSE(pr, ev)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error encoding event", "id", ev.ID, "err", err)
+			return true
+		}
+		return write(msg)
+	}
+	for _, ev := range missed {
+		if !send(ev) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(s.cfg.EventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev := <-sub.events:
+			if !send(ev) {
+				return
+			}
+			heartbeat.Reset(s.cfg.EventsHeartbeat)
+		case <-heartbeat.C:
+			if !write(": heartbeat\n\n") {
+				return
+			}
+		case <-sub.gone:
+			slog.InfoContext(r.Context(), "event stream closed by server")
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// formatSSE renders ev with pr as one SSE message. JSON never contains a
+// raw newline, so the payload always fits on a single data line.
+func formatSSE(pr projection, ev changeEvent) (string, error) {
+	data, err := json.Marshal(pr.event(ev))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data), nil
+}
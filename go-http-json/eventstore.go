@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Change event types.
+const (
+	eventCreated  = "created"
+	eventUpdated  = "updated"
+	eventDeleted  = "deleted"
+	eventRestored = "restored"
+	eventPurged   = "purged"
+)
+
+// changeEventTypes lists every event type, for validating subscriptions.
+var changeEventTypes = []string{eventCreated, eventUpdated, eventDeleted, eventRestored, eventPurged}
+
+// changeEvent describes one successful change to a person. For deletes,
+// Person is the tombstone. For purges, only its ID is set: the event is
+// kept by the SSE buffer and webhook deliveries, which must not hold what
+// the purge erased. Actor is the principal that made the change, or
+// "anonymous" when authentication is off.
+type changeEvent struct {
+	ID      uint64    `json:"id" validate:"required"`
+	Type    string    `json:"type" validate:"required,enum=created|updated|deleted|restored|purged"`
+	Time    time.Time `json:"time" validate:"required"`
+	Version int       `json:"version" validate:"required"`
+	Actor   string    `json:"actor" validate:"required"`
+	Person  Person    `json:"person" validate:"required" doc:"The person after the change. For purged events only id is set."`
+}
+
+// changeSink receives change events. publish is called with the feed's lock
+// held, in ID order, so it must not block.
+type changeSink interface {
+	publish(ev changeEvent)
+}
+
+// eventingStore is a PersonStore decorator that reports every successful
+// mutation of the wrapped store to its sinks. Reads pass straight through.
+// Mutations hold mu until their event is published, so events are in the
+// same order as the changes; both stores serialise writes anyway.
+type eventingStore struct {
+	PersonStore
+
+	mu    sync.Mutex
+	seq   uint64
+	sinks []changeSink
+}
+
+// newEventingStore wraps store. Event IDs start at the current Unix time in
+// microseconds, so they keep increasing across restarts and a client's
+// Last-Event-ID from a previous run is recognised as too old.
+func newEventingStore(store PersonStore, sinks ...changeSink) *eventingStore {
+	return &eventingStore{
+		PersonStore: store,
+		seq:         uint64(time.Now().UnixMicro()),
+		sinks:       sinks,
+	}
+}
+
+// emit assigns the next ID to a change and hands it to every sink. The
+// caller must hold s.mu.
+func (s *eventingStore) emit(ctx context.Context, typ string, p Person) {
+	s.seq++
+	ev := changeEvent{ID: s.seq, Type: typ, Time: time.Now().UTC(), Version: p.Version, Actor: actorFrom(ctx), Person: p}
+	for _, sink := range s.sinks {
+		sink.publish(ev)
+	}
+}
+
+// actorFrom names who is making a change.
+func actorFrom(ctx context.Context) string {
+	if p, ok := principalFrom(ctx); ok {
+		return p.ID
+	}
+	return "anonymous"
+}
+
+func (s *eventingStore) Create(ctx context.Context, p Person) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created, err := s.PersonStore.Create(ctx, p)
+	if err != nil {
+		return created, err
+	}
+	s.emit(ctx, eventCreated, created)
+	return created, nil
+}
+
+func (s *eventingStore) CreateMany(ctx context.Context, people []Person) ([]Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created, err := s.PersonStore.CreateMany(ctx, people)
+	if err != nil {
+		return created, err
+	}
+	for _, p := range created {
+		s.emit(ctx, eventCreated, p)
+	}
+	return created, nil
+}
+
+func (s *eventingStore) Update(ctx context.Context, id int, apply func(p *Person) error) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated, err := s.PersonStore.Update(ctx, id, apply)
+	if err != nil {
+		return updated, err
+	}
+	s.emit(ctx, eventUpdated, updated)
+	return updated, nil
+}
+
+func (s *eventingStore) Delete(ctx context.Context, id int, check func(p Person) error) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted, err := s.PersonStore.Delete(ctx, id, check)
+	if err != nil {
+		return deleted, err
+	}
+	s.emit(ctx, eventDeleted, deleted)
+	return deleted, nil
+}
+
+func (s *eventingStore) Restore(ctx context.Context, id int) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	restored, err := s.PersonStore.Restore(ctx, id)
+	if err != nil {
+		return restored, err
+	}
+	s.emit(ctx, eventRestored, restored)
+	return restored, nil
+}
+
+func (s *eventingStore) Purge(ctx context.Context, cutoff time.Time) ([]Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged, err := s.PersonStore.Purge(ctx, cutoff)
+	if err != nil {
+		return purged, err
+	}
+	for _, p := range purged {
+		s.emit(ctx, eventPurged, Person{ID: p.ID, Version: p.Version})
+	}
+	return purged, nil
+}
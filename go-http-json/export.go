@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats for GET /people, chosen with ?format= or the Accept header.
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+// formatMediaTypes maps each format to its Content-Type.
+var formatMediaTypes = map[string]string{
+	formatJSON:   "application/json",
+	formatNDJSON: "application/x-ndjson",
+	formatCSV:    "text/csv",
+}
+
+// flushEvery is how many rows are written between explicit flushes, so large
+// exports reach the client progressively instead of all at the end.
+const flushEvery = 1000
+
+// negotiateFormat picks the response format. An explicit ?format= wins;
+// otherwise the Accept header is matched by quality value, and JSON is used
+// when there is no Accept header or it allows anything.
+func negotiateFormat(r *http.Request) (string, bool) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		_, ok := formatMediaTypes[f]
+		return f, ok
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatJSON, true
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		var format string
+		switch mediaType {
+		case "*/*", "application/*", "application/json":
+			format = formatJSON
+		case "application/x-ndjson", "application/jsonl":
+			format = formatNDJSON
+		case "text/csv", "text/*":
+			format = formatCSV
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best, best != ""
+}
+
+// writePeople streams one page of people in the given format, rendered by
+// pr. next is the URL of the following page, or "" on the last one. For
+// JSON it goes in the envelope; for NDJSON and CSV, which have no envelope,
+// it is sent as a Link header.
+func writePeople(w http.ResponseWriter, format string, pr projection, page []Person, next string) error {
+	w.Header().Set("Content-Type", formatMediaTypes[format])
+	if format == formatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	if next != "" && format != formatJSON {
+		w.Header().Add("Link", "<"+next+`>; rel="next"`)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	switch format {
+	case formatNDJSON:
+		return writePeopleNDJSON(w, pr, page)
+	case formatCSV:
+		return writePeopleCSV(w, pr, page)
+	}
+	return writePeopleJSON(w, pr, page, next)
+}
+
+// peoplePage is the shape of the v2 JSON list response; peoplePageV1 is
+// the v1 one. writePeopleJSON streams it by hand; the types exist so the
+// OpenAPI document can describe them.
+type peoplePage struct {
+	Data []Person `json:"data" validate:"required"`
+	Next string   `json:"next,omitempty"`
+}
+
+// writePeopleJSON writes {"data":[...],"next":"..."} one person at a time
+// instead of building the whole envelope in memory.
+func writePeopleJSON(w http.ResponseWriter, pr projection, page []Person, next string) error {
+	rc := http.NewResponseController(w)
+
+	_, err := w.Write([]byte(`{"data":[`))
+	if err != nil {
+		return err
+	}
+	for i, p := range page {
+		if i > 0 {
+			_, err = w.Write([]byte(","))
+			if err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(pr.person(p))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+		if (i+1)%flushEvery == 0 {
+			rc.Flush()
+		}
+	}
+	_, err = w.Write([]byte("]"))
+	if err != nil {
+		return err
+	}
+
+	if next != "" {
+		// Keep "&" in the next link readable instead of escaping it as \u0026.
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		err = enc.Encode(next)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(`,"next":` + strings.TrimSuffix(buf.String(), "\n")))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write([]byte("}\n"))
+	return err
+}
+
+// writePeopleNDJSON writes one JSON object per line.
+func writePeopleNDJSON(w http.ResponseWriter, pr projection, page []Person) error {
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	for i, p := range page {
+		err := enc.Encode(pr.person(p))
+		if err != nil {
+			return err
+		}
+		if (i+1)%flushEvery == 0 {
+			rc.Flush()
+		}
+	}
+	return nil
+}
+
+// csvHeaders are the first row of a CSV export in each API version. v2
+// joins tags with ";" and spreads the address over four columns.
+var csvHeaders = map[apiVersion][]string{
+	apiV1: {"id", "name", "age", "deleted_at"},
+	apiV2: {"id", "name", "age", "email", "phone", "tags", "street", "city", "postal_code", "country", "created_at", "updated_at", "deleted_at"},
+}
+
+// csvColumnFields maps the CSV columns that have no JSON field of their own
+// to the field they come from, so ?fields=address keeps all four.
+var csvColumnFields = map[string]string{
+	"street":      "address",
+	"city":        "address",
+	"postal_code": "address",
+	"country":     "address",
+}
+
+// writePeopleCSV writes a header row followed by one row per person. The
+// columns are those of csvHeaders kept by pr, then its computed fields.
+func writePeopleCSV(w http.ResponseWriter, pr projection, page []Person) error {
+	rc := http.NewResponseController(w)
+	cw := csv.NewWriter(w)
+
+	header := csvHeaders[pr.version]
+	var keep []int
+	for i, col := range header {
+		if pr.keeps(cmp.Or(csvColumnFields[col], col)) {
+			keep = append(keep, i)
+		}
+	}
+	computed := pr.included()
+	columns := func(cells []string) []string {
+		out := make([]string, 0, len(keep)+len(computed))
+		for _, i := range keep {
+			out = append(out, cells[i])
+		}
+		return out
+	}
+
+	row := columns(header)
+	for _, c := range computed {
+		row = append(row, c.name)
+	}
+	err := cw.Write(row)
+	if err != nil {
+		return err
+	}
+	for i, p := range page {
+		row = columns(csvRow(pr.version, p))
+		for _, c := range computed {
+			row = append(row, csvSafe(fmt.Sprint(c.compute(p))))
+		}
+		err = cw.Write(row)
+		if err != nil {
+			return err
+		}
+		if (i+1)%flushEvery == 0 {
+			cw.Flush()
+			rc.Flush()
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvRow returns the cells of p in the column order of csvHeaders[v].
+func csvRow(v apiVersion, p Person) []string {
+	deletedAt := ""
+	if p.DeletedAt != nil {
+		deletedAt = p.DeletedAt.Format(time.RFC3339)
+	}
+	if v == apiV1 {
+		return []string{strconv.Itoa(p.ID), csvSafe(p.Name), strconv.Itoa(p.Age), deletedAt}
+	}
+
+	var addr Address
+	if p.Address != nil {
+		addr = *p.Address
+	}
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	// Phone is written as is: E.164 numbers all start with "+", and
+	// phonePattern already rules out anything a spreadsheet would evaluate.
+	return []string{
+		strconv.Itoa(p.ID), csvSafe(p.Name), strconv.Itoa(p.Age),
+		csvSafe(p.Email), p.Phone, strings.Join(p.Tags, ";"),
+		csvSafe(addr.Street), csvSafe(addr.City), csvSafe(addr.PostalCode), addr.Country,
+		timestamp(p.CreatedAt), timestamp(p.UpdatedAt), deletedAt,
+	}
+}
+
+// csvSafe stops spreadsheet applications from treating a cell as a formula
+// by prefixing values that start with a formula character with a quote.
+func csvSafe(s string) string {
+	if s != "" && slices.Contains([]byte("=+-@\t\r"), s[0]) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// computedField is a derived field that ?include= can add to a person.
+// schema documents its value in /openapi.json.
+type computedField struct {
+	name    string
+	compute func(Person) any
+	schema  map[string]any
+}
+
+// computedFields are the available computed fields, in the order they are
+// written.
+var computedFields = []computedField{
+	{"age_group", ageGroup, map[string]any{"type": "string", "enum": []string{"child", "teen", "adult", "senior"}}},
+	{"initials", initials, map[string]any{"type": "string"}},
+}
+
+// viewFields are the JSON fields of a person in each API version, in the
+// order they are encoded. ?fields= may name any of them.
+var viewFields = map[apiVersion][]string{
+	apiV1: jsonFieldNames(reflect.TypeOf(personV1{})),
+	apiV2: jsonFieldNames(reflect.TypeOf(Person{})),
+}
+
+// jsonFieldNames lists the names encoding/json uses for the fields of t.
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.IsExported() && name != "-" {
+			names = append(names, cmp.Or(name, f.Name))
+		}
+	}
+	return names
+}
+
+// projection is how people are rendered in a response: the API version,
+// the fields kept by ?fields= (nil keeps all of them) and the computed
+// fields added by ?include=. A projection with no fields and no include is
+// the full representation of the version.
+type projection struct {
+	version apiVersion
+	fields  []string
+	include []string
+}
+
+// parseProjection reads ?fields= and ?include=, both comma-separated, for a
+// response in version v. An empty ?fields= is an error rather than an
+// empty object.
+func parseProjection(q url.Values, v apiVersion) (projection, error) {
+	var fields []string
+	if q.Has("fields") {
+		fields = splitList(q.Get("fields"))
+		if len(fields) == 0 {
+			return projection{}, fmt.Errorf("fields must name at least one of %s", strings.Join(viewFields[v], ", "))
+		}
+	}
+	return newProjection(v, fields, splitList(q.Get("include")))
+}
+
+// newProjection checks the field and include names against version v.
+func newProjection(v apiVersion, fields, include []string) (projection, error) {
+	for _, f := range fields {
+		if !slices.Contains(viewFields[v], f) {
+			return projection{}, fmt.Errorf("cannot select field %q; use any of %s", f, strings.Join(viewFields[v], ", "))
+		}
+	}
+	names := make([]string, len(computedFields))
+	for i, c := range computedFields {
+		names[i] = c.name
+	}
+	for _, f := range include {
+		if !slices.Contains(names, f) {
+			return projection{}, fmt.Errorf("cannot include %q; use any of %s", f, strings.Join(names, ", "))
+		}
+	}
+	return projection{version: v, fields: fields, include: include}, nil
+}
+
+// splitList splits a comma-separated parameter, dropping blanks.
+func splitList(s string) []string {
+	var items []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// full reports whether pr leaves the representation unchanged.
+func (pr projection) full() bool {
+	return pr.fields == nil && len(pr.include) == 0
+}
+
+// keeps reports whether the field of the version's representation is kept.
+func (pr projection) keeps(field string) bool {
+	return pr.fields == nil || slices.Contains(pr.fields, field)
+}
+
+// included returns the computed fields pr adds, in computedFields order.
+func (pr projection) included() []computedField {
+	var fields []computedField
+	for _, c := range computedFields {
+		if slices.Contains(pr.include, c.name) {
+			fields = append(fields, c)
+		}
+	}
+	return fields
+}
+
+// person renders p. Without ?fields= or ?include= this is personView;
+// otherwise it is a projectedPerson, built when it is encoded.
+func (pr projection) person(p Person) any {
+	view := personView(pr.version, p)
+	if pr.full() {
+		return view
+	}
+	return projectedPerson{pr: pr, person: p, view: view}
+}
+
+// projectedPerson is a person shaped by a projection. Building it in
+// MarshalJSON means any encoding error reaches the caller's encoder
+// instead of producing a field with no value.
+type projectedPerson struct {
+	pr     projection
+	person Person
+	view   any
+}
+
+// MarshalJSON writes the kept fields of the view in the order of the full
+// representation, followed by the computed fields.
+func (pp projectedPerson) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(pp.view)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	write := func(name string, value []byte) {
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", name)
+		buf.Write(value)
+	}
+	for _, f := range viewFields[pp.pr.version] {
+		if value, ok := all[f]; ok && pp.pr.keeps(f) {
+			write(f, value)
+		}
+	}
+	for _, c := range pp.pr.included() {
+		value, err := json.Marshal(c.compute(pp.person))
+		if err != nil {
+			return nil, fmt.Errorf("computed field %s: %w", c.name, err)
+		}
+		write(c.name, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// event renders ev with its person projected. The envelope itself is never
+// trimmed, so clients can still resume by ID and tell event types apart.
+func (pr projection) event(ev changeEvent) any {
+	if ev.Type == eventPurged {
+		// Only the ID is left; computed fields would describe nobody.
+		pr.include = nil
+	}
+	if pr.full() {
+		return eventView(pr.version, ev)
+	}
+	return struct {
+		ID      uint64    `json:"id"`
+		Type    string    `json:"type"`
+		Time    time.Time `json:"time"`
+		Version int       `json:"version"`
+		Actor   string    `json:"actor"`
+		Person  any       `json:"person"`
+	}{ev.ID, ev.Type, ev.Time, ev.Version, ev.Actor, pr.person(ev.Person)}
+}
+
+// ageGroup buckets an age: child under 13, teen under 18, adult under 65,
+// senior from 65.
+func ageGroup(p Person) any {
+	switch {
+	case p.Age < 13:
+		return "child"
+	case p.Age < 18:
+		return "teen"
+	case p.Age < 65:
+		return "adult"
+	}
+	return "senior"
+}
+
+// initials returns the upper-cased first letter of each word of the name,
+// so "Ada King Lovelace" becomes "AKL".
+func initials(p Person) any {
+	var b strings.Builder
+	for word := range strings.FieldsSeq(p.Name) {
+		r, _ := utf8.DecodeRuneInString(word)
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
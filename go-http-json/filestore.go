@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// peopleFileName is the snapshot file written inside the data directory.
+const peopleFileName = "people.json"
+
+// fileSnapshot is the on-disk format of a fileStore.
+type fileSnapshot struct {
+	NextID int            `json:"next_id"`
+	People []storedPerson `json:"people"`
+}
+
+// storedPerson adds the fields that Person hides from API clients.
+type storedPerson struct {
+	Person
+	Version int `json:"version"`
+}
+
+// fileStore is a PersonStore that keeps everything in memory and rewrites a
+// JSON snapshot after every successful mutation. Reads are served from the
+// embedded memoryStore; mutations hold its write lock until the snapshot is
+// on disk, and are rolled back in memory if the write fails.
+type fileStore struct {
+	*memoryStore
+	path string
+}
+
+// openFileStore loads the snapshot from dir, creating dir if needed.
+// The returned bool reports whether a snapshot already existed.
+func openFileStore(dir string) (*fileStore, bool, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, false, fmt.Errorf("create data dir: %w", err)
+	}
+
+	s := &fileStore{
+		memoryStore: newMemoryStore(),
+		path:        filepath.Join(dir, peopleFileName),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("read snapshot: %w", err)
+	}
+
+	var snap fileSnapshot
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return nil, false, fmt.Errorf("decode snapshot %s: %w", s.path, err)
+	}
+
+	for _, sp := range snap.People {
+		p := sp.Person
+		p.Version = max(sp.Version, 1) // snapshots written before versioning have none
+		s.people[p.ID] = p
+		// Never hand out an ID that is already on disk, even if next_id is stale.
+		if p.ID >= s.nextID {
+			s.nextID = p.ID + 1
+		}
+	}
+	if snap.NextID > s.nextID {
+		s.nextID = snap.NextID
+	}
+
+	return s, true, nil
+}
+
+func (s *fileStore) Create(ctx context.Context, p Person) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.ID = s.nextID
+	p.Version = 1
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	s.people[p.ID] = p
+	s.nextID++
+
+	err := s.persist()
+	if err != nil {
+		delete(s.people, p.ID)
+		s.nextID--
+		return Person{}, err
+	}
+	return p, nil
+}
+
+func (s *fileStore) CreateMany(ctx context.Context, people []Person) ([]Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	firstID := s.nextID
+	now := time.Now().UTC()
+	created := make([]Person, len(people))
+	for i, p := range people {
+		p.ID = s.nextID
+		p.Version = 1
+		p.CreatedAt, p.UpdatedAt = now, now
+		s.nextID++
+		s.people[p.ID] = p
+		created[i] = p
+	}
+
+	// One snapshot for the whole batch keeps bulk imports linear.
+	err := s.persist()
+	if err != nil {
+		for id := firstID; id < s.nextID; id++ {
+			delete(s.people, id)
+		}
+		s.nextID = firstID
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *fileStore) Update(ctx context.Context, id int, apply func(p *Person) error) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.live(id)
+	if !ok {
+		return Person{}, errPersonNotFound
+	}
+
+	p := old
+	err := apply(&p)
+	if err != nil {
+		return Person{}, err
+	}
+	p.ID = id
+	p.Version = old.Version + 1
+	p.CreatedAt = old.CreatedAt
+	p.UpdatedAt = time.Now().UTC()
+	p.DeletedAt = nil
+	s.people[id] = p
+
+	err = s.persist()
+	if err != nil {
+		s.people[id] = old
+		return Person{}, err
+	}
+	return p, nil
+}
+
+func (s *fileStore) Delete(ctx context.Context, id int, check func(p Person) error) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.people[id]
+	p, err := s.tombstone(id, check)
+	if err != nil {
+		return Person{}, err
+	}
+
+	err = s.persist()
+	if err != nil {
+		s.people[id] = old
+		return Person{}, err
+	}
+	return p, nil
+}
+
+func (s *fileStore) Restore(ctx context.Context, id int) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.people[id]
+	p, err := s.restore(id)
+	if err != nil {
+		return Person{}, err
+	}
+
+	err = s.persist()
+	if err != nil {
+		s.people[id] = old
+		return Person{}, err
+	}
+	return p, nil
+}
+
+func (s *fileStore) Purge(ctx context.Context, cutoff time.Time) ([]Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := s.purge(cutoff)
+	if len(purged) == 0 {
+		return nil, nil
+	}
+
+	err := s.persist()
+	if err != nil {
+		for _, p := range purged {
+			s.people[p.ID] = p
+		}
+		return nil, err
+	}
+	return purged, nil
+}
+
+// Check writes, syncs and removes a small file next to the snapshot, which
+// catches a read-only or full disk and a removed data directory.
+func (s *fileStore) Check(ctx context.Context) error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte("ok"))
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	return errors.Join(err, closeErr)
+}
+
+// Close writes a final snapshot so the file matches memory on exit.
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.persist()
+}
+
+// persist writes the current state to disk. The caller must hold s.mu.
+func (s *fileStore) persist() error {
+	snap := fileSnapshot{
+		NextID: s.nextID,
+		People: make([]storedPerson, 0, len(s.people)),
+	}
+	for _, p := range s.people {
+		snap.People = append(snap.People, storedPerson{Person: p, Version: p.Version})
+	}
+	slices.SortFunc(snap.People, func(a, b storedPerson) int { return a.ID - b.ID })
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes data to a temp file in the same directory, syncs it,
+// and renames it over path, so readers never observe a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	// Remove the temp file on any failure; after a successful rename this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write temp file: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("replace %s: %w", path, err)
+	}
+	return nil
+}
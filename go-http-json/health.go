@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// healthCheckTimeout bounds each check so a hung disk cannot hang a probe.
+const healthCheckTimeout = 2 * time.Second
+
+// errDiskSpaceUnsupported is returned by freeDiskSpace on platforms where it
+// is not implemented; the disk check then passes.
+var errDiskSpaceUnsupported = errors.New("free disk space is not available on this platform")
+
+// healthCheck is one named probe. A nil error means healthy.
+type healthCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// health tracks the process lifecycle for the probes: started is set once
+// the listener is bound, draining once shutdown begins.
+type health struct {
+	started  atomic.Bool
+	draining atomic.Bool
+}
+
+// checkResult is the outcome of one check in a verbose probe response.
+type checkResult struct {
+	Name       string  `json:"name" validate:"required"`
+	Status     string  `json:"status" validate:"required,enum=ok|fail"`
+	DurationMS float64 `json:"duration_ms" validate:"required"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// healthReport is the body of /livez and /readyz. Checks are only included
+// with ?verbose.
+type healthReport struct {
+	Status string        `json:"status" validate:"required,enum=ok|fail"`
+	Checks []checkResult `json:"checks,omitempty"`
+}
+
+// livenessChecks decide whether the process should be restarted. They must
+// not depend on the store or the disk: a broken disk is a reason to stop
+// sending traffic, not to restart in a loop.
+func (s *server) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "ping", run: func(ctx context.Context) error { return nil }},
+	}
+}
+
+// readinessChecks decide whether the server should receive traffic.
+func (s *server) readinessChecks() []healthCheck {
+	checks := []healthCheck{
+		{name: "startup", run: func(ctx context.Context) error {
+			if !s.health.started.Load() {
+				return errors.New("server is still starting")
+			}
+			return nil
+		}},
+		{name: "shutdown", run: func(ctx context.Context) error {
+			if s.health.draining.Load() {
+				return errors.New("server is shutting down")
+			}
+			return nil
+		}},
+		{name: "store", run: s.store.Check},
+	}
+	if s.cfg.DataDir != "" {
+		checks = append(checks, healthCheck{name: "disk", run: s.checkDiskSpace})
+	}
+	return checks
+}
+
+// checkDiskSpace fails when the data directory has less than
+// cfg.MinFreeDisk bytes available.
+func (s *server) checkDiskSpace(ctx context.Context) error {
+	free, err := freeDiskSpace(s.cfg.DataDir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < uint64(s.cfg.MinFreeDisk) {
+		return fmt.Errorf("%d bytes free in %s, need %d", free, s.cfg.DataDir, s.cfg.MinFreeDisk)
+	}
+	return nil
+}
+
+// probeHandler returns a handler that runs checks and answers 200 if all
+// pass and 503 otherwise. With ?verbose the result of every check, with its
+// latency, is included.
+func (s *server) probeHandler(checks func() []healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, r, "GET, HEAD")
+			return
+		}
+
+		report := healthReport{Status: "ok"}
+		for _, c := range checks() {
+			res := runHealthCheck(r.Context(), c)
+			if res.Status != "ok" {
+				report.Status = "fail"
+				slog.WarnContext(r.Context(), "health check failed", "check", c.name, "err", res.Error)
+			}
+			report.Checks = append(report.Checks, res)
+		}
+		if !r.URL.Query().Has("verbose") {
+			report.Checks = nil
+		}
+
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error encoding health report", "err", err)
+		}
+	}
+}
+
+// runHealthCheck runs c with a timeout and times it. The check runs in its
+// own goroutine because file system calls ignore ctx: if one hangs, the
+// probe still fails after healthCheckTimeout, and the goroutine is left to
+// finish whenever the call returns.
+func runHealthCheck(ctx context.Context, c healthCheck) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- c.run(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("check did not finish: %w", ctx.Err())
+	}
+	res := checkResult{
+		Name:       c.name,
+		Status:     "ok",
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = "fail"
+		res.Error = err.Error()
+	}
+	return res
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// historyFileName is the append-only revision log in the data dir.
+const historyFileName = "history.jsonl"
+
+// revisionBaseline marks the first revision of a person that already existed
+// when history recording started, e.g. the sample data or an older snapshot.
+const revisionBaseline = "baseline"
+
+// fieldChange is one field that differs between two revisions. From is null
+// on create.
+type fieldChange struct {
+	Field string `json:"field" validate:"required"`
+	From  any    `json:"from"`
+	To    any    `json:"to"`
+}
+
+// revision records one change to a person: who made it, when, which fields
+// changed and the resulting state. After a delete the state is the
+// tombstone, with deleted_at set. A purge replaces every earlier revision
+// with a single one that has no changes and a null state.
+type revision struct {
+	EventID  uint64        `json:"event_id,omitempty"`
+	PersonID int           `json:"person_id" validate:"required"`
+	Version  int           `json:"version" validate:"required"`
+	Type     string        `json:"type" validate:"required,enum=baseline|created|updated|deleted|restored|purged"`
+	Time     time.Time     `json:"time" validate:"required"`
+	Actor    string        `json:"actor" validate:"required"`
+	Changes  []fieldChange `json:"changes" validate:"required"`
+	Person   *Person       `json:"person" validate:"required"`
+}
+
+// historyRetryInterval is how long the writer waits before trying again
+// after the log file could not be written.
+const historyRetryInterval = time.Second
+
+// historyLog is a changeSink that keeps every revision of every person in
+// memory, ordered by time, and appends each one as a JSON line to
+// history.jsonl when a data dir is set. The history of deleted people stays
+// available for audits until they are purged; a purge erases everything the
+// person held, in memory and on disk.
+//
+// publish runs under the eventing store's lock, so it usually only queues
+// revisions and a writer goroutine appends them to the file. A purge is the
+// exception: its revision is written and synced before publish returns, so
+// a crash cannot bring the purged revisions back. The writer then rewrites
+// the whole file without them.
+type historyLog struct {
+	mu      sync.RWMutex
+	byID    map[int][]revision
+	queue   []revision // waiting for the writer, guarded by mu
+	compact bool       // the file must be rewritten from memory, guarded by mu
+
+	path   string // empty keeps history in memory only
+	fileMu sync.Mutex
+	file   *os.File // guarded by fileMu, which is taken after mu, never before
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// openHistoryLog loads the revision log from dataDir, if any, and opens it
+// for appending. A partial last line, left by a crash mid-write, is cut off.
+// A purged revision drops every earlier revision of that person; if the
+// file still held any, it is rewritten without them.
+func openHistoryLog(dataDir string) (*historyLog, error) {
+	h := &historyLog{
+		byID: make(map[int][]revision),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if dataDir == "" {
+		return h, nil
+	}
+
+	path := filepath.Join(dataDir, historyFileName)
+	h.path = path
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("read history: %w", err)
+	}
+	complete := data[:bytes.LastIndexByte(data, '\n')+1]
+	for n, line := range bytes.Split(complete, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rev revision
+		err = json.Unmarshal(line, &rev)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s line %d: %w", path, n+1, err)
+		}
+		if rev.Person != nil {
+			rev.Person.Version = rev.Version
+		}
+		if rev.Type == eventPurged && len(h.byID[rev.PersonID]) > 0 {
+			// The rewrite after this purge never finished.
+			delete(h.byID, rev.PersonID)
+			h.compact = true
+		}
+		h.byID[rev.PersonID] = append(h.byID[rev.PersonID], rev)
+	}
+
+	h.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open history: %w", err)
+	}
+	if len(complete) < len(data) {
+		slog.Warn("dropping partial last line of history", "path", path, "bytes", len(data)-len(complete))
+		err = h.file.Truncate(int64(len(complete)))
+		if err != nil {
+			h.file.Close()
+			return nil, fmt.Errorf("truncate history: %w", err)
+		}
+	}
+	if h.compact {
+		h.wake <- struct{}{}
+	}
+	go h.run()
+	return h, nil
+}
+
+// publish turns ev into a revision, diffed against the person's previous
+// revision. The eventing store serialises mutations with their events, so
+// revisions arrive in the order the changes were made.
+//
+// A purge drops the person's earlier revisions and records only who purged
+// it and when, so no revision or point-in-time read can return what it
+// held.
+func (h *historyLog) publish(ev changeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	rev := revision{
+		EventID:  ev.ID,
+		PersonID: ev.Person.ID,
+		Version:  ev.Version,
+		Type:     ev.Type,
+		Time:     ev.Time,
+		Actor:    ev.Actor,
+	}
+	if ev.Type == eventPurged {
+		delete(h.byID, ev.Person.ID)
+		rev.Changes = []fieldChange{}
+		h.append(rev)
+		h.writePurge()
+		return
+	}
+
+	var before *Person
+	if revs := h.byID[ev.Person.ID]; len(revs) > 0 {
+		before = revs[len(revs)-1].Person
+	}
+	rev.Changes = diffPeople(before, &ev.Person)
+	rev.Person = &ev.Person
+	h.append(rev)
+}
+
+// append records rev and queues it for the writer. The caller must hold h.mu.
+func (h *historyLog) append(rev revision) {
+	h.byID[rev.PersonID] = append(h.byID[rev.PersonID], rev)
+	if h.path == "" {
+		return
+	}
+	h.queue = append(h.queue, rev)
+	h.signal()
+}
+
+// signal wakes the writer without waiting for it.
+func (h *historyLog) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writePurge appends the queue, which ends with a purged revision, and
+// syncs the file. From then on a restart drops the purged revisions even if
+// the rewrite that follows never happens. If the write fails, the writer
+// retries the rewrite until it succeeds. The caller must hold h.mu.
+func (h *historyLog) writePurge() {
+	if h.path == "" {
+		return
+	}
+	h.compact = true
+	queue := h.queue
+	h.queue = nil
+
+	h.fileMu.Lock()
+	defer h.fileMu.Unlock()
+	var buf bytes.Buffer
+	encodeRevisions(&buf, queue)
+	_, err := h.file.Write(buf.Bytes())
+	if err == nil {
+		err = h.file.Sync()
+	}
+	if err != nil {
+		slog.Error("write purge to history", "err", err)
+	}
+}
+
+// run writes queued revisions until Close is called, then writes the rest.
+// After a failed write it tries again every historyRetryInterval.
+func (h *historyLog) run() {
+	defer close(h.done)
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-h.wake:
+		case <-retry:
+		case <-h.stop:
+			err := h.flush()
+			if err != nil {
+				slog.Error("write history", "err", err)
+			}
+			return
+		}
+		retry = nil
+		err := h.flush()
+		if err != nil {
+			slog.Error("write history", "err", err, "retry_in", historyRetryInterval)
+			retry = time.After(historyRetryInterval)
+		}
+	}
+}
+
+// flush appends the queued revisions to the log file in one write, or
+// rewrites the file from memory after a purge or a failed write. Memory is
+// always complete, so any failure is repaired by the next rewrite.
+func (h *historyLog) flush() error {
+	h.mu.Lock()
+	queue := h.queue
+	h.queue = nil
+	var all map[int][]revision
+	if h.compact {
+		// The rewrite covers everything queued so far.
+		h.compact = false
+		all = maps.Clone(h.byID)
+		queue = nil
+	}
+	// Take the file before letting go of mu, so a purge written meanwhile
+	// cannot land ahead of revisions made before it.
+	h.fileMu.Lock()
+	h.mu.Unlock()
+
+	var err error
+	if all != nil {
+		err = h.rewrite(all)
+	} else {
+		var buf bytes.Buffer
+		encodeRevisions(&buf, queue)
+		if buf.Len() > 0 {
+			_, err = h.file.Write(buf.Bytes())
+		}
+	}
+	h.fileMu.Unlock()
+
+	if err != nil {
+		h.mu.Lock()
+		h.compact = true
+		h.mu.Unlock()
+	}
+	return err
+}
+
+// rewrite atomically replaces the log file with all, ordered by person ID,
+// and reopens it for appending. The caller must hold h.fileMu.
+func (h *historyLog) rewrite(all map[int][]revision) error {
+	var buf bytes.Buffer
+	for _, id := range slices.Sorted(maps.Keys(all)) {
+		encodeRevisions(&buf, all[id])
+	}
+	err := writeFileAtomic(h.path, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("reopen history: %w", err)
+	}
+	h.file.Close()
+	h.file = f
+	return nil
+}
+
+// encodeRevisions writes revs to buf as JSON lines.
+func encodeRevisions(buf *bytes.Buffer, revs []revision) {
+	for _, rev := range revs {
+		line, err := json.Marshal(rev)
+		if err != nil {
+			slog.Error("encode history", "person", rev.PersonID, "err", err)
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+}
+
+// seed adds a baseline revision for every person and tombstone in store
+// that has no history yet, so later diffs and point-in-time reads have a
+// starting point. It must run before the server takes traffic.
+func (h *historyLog) seed(ctx context.Context, store PersonStore) error {
+	people, err := store.List(ctx)
+	if err != nil {
+		return err
+	}
+	deleted, err := store.ListDeleted(ctx)
+	if err != nil {
+		return err
+	}
+	people = append(people, deleted...)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, p := range people {
+		if len(h.byID[p.ID]) > 0 {
+			continue
+		}
+		h.append(revision{
+			PersonID: p.ID,
+			Version:  p.Version,
+			Type:     revisionBaseline,
+			Time:     now,
+			Actor:    "system",
+			Changes:  diffPeople(nil, &p),
+			Person:   &p,
+		})
+	}
+	return nil
+}
+
+// revisions returns the history of one person, oldest first.
+func (h *historyLog) revisions(id int) []revision {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return slices.Clone(h.byID[id])
+}
+
+// stateAt returns the person as of t from its revisions, or false if it did
+// not exist then. With includeDeleted, a tombstone counts as existing.
+// Revisions written before soft delete record a delete with a null state.
+func stateAt(revs []revision, t time.Time, includeDeleted bool) (Person, bool) {
+	for i := len(revs) - 1; i >= 0; i-- {
+		if revs[i].Time.After(t) {
+			continue
+		}
+		p := revs[i].Person
+		if p == nil || (p.DeletedAt != nil && !includeDeleted) {
+			return Person{}, false
+		}
+		return *p, true
+	}
+	return Person{}, false
+}
+
+// personAt reconstructs one person as of t.
+func (h *historyLog) personAt(id int, t time.Time) (Person, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	p, ok := stateAt(h.byID[id], t, false)
+	if !ok {
+		return Person{}, errPersonNotFound
+	}
+	return p, nil
+}
+
+// peopleAt reconstructs the whole list as of t, ordered by ID.
+func (h *historyLog) peopleAt(t time.Time, includeDeleted bool) []Person {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	people := make([]Person, 0, len(h.byID))
+	for _, revs := range h.byID {
+		if p, ok := stateAt(revs, t, includeDeleted); ok {
+			people = append(people, p)
+		}
+	}
+	sortPeopleByID(people)
+	return people
+}
+
+// Close writes what is still queued, then syncs and closes the log file.
+func (h *historyLog) Close() error {
+	if h.path == "" {
+		return nil
+	}
+	close(h.stop)
+	<-h.done
+
+	h.fileMu.Lock()
+	defer h.fileMu.Unlock()
+	err := h.file.Sync()
+	closeErr := h.file.Close()
+	return errors.Join(err, closeErr)
+}
+
+// storeManagedFields are left out of diffs: the ID never changes and the
+// revision has its own time.
+var storeManagedFields = []string{"id", "created_at", "updated_at"}
+
+// diffPeople lists the JSON fields that differ between two states, sorted by
+// name. Either side may be nil. Comparing the JSON form means new Person
+// fields are covered without changes here.
+func diffPeople(before, after *Person) []fieldChange {
+	from, to := personFields(before), personFields(after)
+	var names []string
+	for f := range from {
+		names = append(names, f)
+	}
+	for f := range to {
+		if _, ok := from[f]; !ok {
+			names = append(names, f)
+		}
+	}
+	slices.Sort(names)
+
+	changes := []fieldChange{}
+	for _, f := range names {
+		if !slices.Contains(storeManagedFields, f) && !bytes.Equal(from[f], to[f]) {
+			changes = append(changes, fieldChange{Field: f, From: from[f], To: to[f]})
+		}
+	}
+	return changes
+}
+
+// personFields returns the JSON fields of p. A nil p has none.
+func personFields(p *Person) map[string]json.RawMessage {
+	if p == nil {
+		return nil
+	}
+	data, _ := json.Marshal(p)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// parseAsOf reads the ?as_of= timestamp of a point-in-time read.
+func parseAsOf(r *http.Request) (t time.Time, ok bool, err error) {
+	return parseAsOfValue(r.URL.Query().Get("as_of"))
+}
+
+// parseAsOfValue parses an as_of timestamp. An empty value means now.
+func parseAsOfValue(v string) (t time.Time, ok bool, err error) {
+	if v == "" {
+		return time.Time{}, false, nil
+	}
+	t, err = time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false, errors.New("as_of must be an RFC 3339 timestamp such as 2026-01-02T15:04:05Z")
+	}
+	return t, true, nil
+}
+
+// personHistoryHandler returns every revision of a person, oldest first.
+// It also works for deleted people.
+func (s *server) personHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	id, ok := personIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	revs := s.history.revisions(id)
+	if len(revs) == 0 {
+		writeStoreError(w, r, errPersonNotFound)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, revisionsView(apiVersionFrom(r.Context()), revs))
+}
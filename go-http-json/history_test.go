@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPurgeErasesHistory(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	history, err := openHistoryLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newEventingStore(newMemoryStore(), history)
+
+	kept, err := store.Create(ctx, Person{Name: "Alice", Age: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := store.Create(ctx, Person{Name: "Bob", Age: 25, Email: "bob@example.com", Phone: "+442071838750"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeDelete := time.Now()
+	_, err = store.Delete(ctx, p.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err := store.Purge(ctx, time.Now().Add(time.Second))
+	if err != nil || len(purged) != 1 {
+		t.Fatalf("Purge = %v, %v; want Bob", purged, err)
+	}
+
+	// check asserts that Bob's data is gone and Alice's is not.
+	check := func(t *testing.T, h *historyLog) {
+		t.Helper()
+		_, err := h.personAt(p.ID, beforeDelete)
+		if !errors.Is(err, errPersonNotFound) {
+			t.Errorf("personAt before delete: err = %v, want errPersonNotFound", err)
+		}
+		revs := h.revisions(p.ID)
+		if len(revs) != 1 || revs[0].Type != eventPurged || revs[0].Person != nil || len(revs[0].Changes) != 0 {
+			t.Errorf("revisions after purge = %+v, want one empty purged revision", revs)
+		}
+		if _, err := h.personAt(kept.ID, time.Now()); err != nil {
+			t.Errorf("personAt for a live person: %v", err)
+		}
+	}
+	check(t, history)
+
+	err = history.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, historyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"Bob", "bob@example.com", "+442071838750"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("%s still holds %q", historyFileName, secret)
+		}
+	}
+	if !bytes.Contains(data, []byte("Alice")) {
+		t.Errorf("%s lost the revisions of a live person", historyFileName)
+	}
+
+	reopened, err := openHistoryLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(t, reopened)
+}
+
+func TestPurgeSurvivesMissedRewrite(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	history, err := openHistoryLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newEventingStore(newMemoryStore(), history)
+	p, err := store.Create(ctx, Person{Name: "Bob", Age: 25, Email: "bob@example.com"})
+	if err == nil {
+		_, err = store.Delete(ctx, p.ID, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop the writer, as a crash would, so only what publish wrote itself
+	// reaches the file.
+	close(history.stop)
+	<-history.done
+	_, err = store.Purge(ctx, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, historyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"type":"purged"`)) {
+		t.Fatalf("purge was not written before Purge returned:\n%s", data)
+	}
+
+	reopened, err := openHistoryLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revs := reopened.revisions(p.ID); len(revs) != 1 || revs[0].Type != eventPurged {
+		t.Errorf("revisions after reopen = %+v, want only the purge", revs)
+	}
+	if got := reopened.peopleAt(time.Now(), true); len(got) != 0 {
+		t.Errorf("peopleAt after reopen = %+v, want nobody", got)
+	}
+	err = reopened.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, historyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("Bob")) {
+		t.Errorf("%s was not rewritten on reopen:\n%s", historyFileName, data)
+	}
+	history.file.Close()
+}
+
+func TestHistoryWriterOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		purge bool // purge a deleted person while the writers run, forcing a rewrite
+	}{
+		{"appends only", false},
+		{"purge midway", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			dir := t.TempDir()
+			history, err := openHistoryLog(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := newEventingStore(newMemoryStore(), history)
+			doomed, err := store.Create(ctx, Person{Name: "Mallory", Age: 40})
+			if err == nil {
+				_, err = store.Delete(ctx, doomed.ID, nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 9)
+			for w := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p, err := store.Create(ctx, Person{Name: "Worker " + strconv.Itoa(w), Age: 20})
+					for i := 0; err == nil && i < 50; i++ {
+						_, err = store.Update(ctx, p.ID, func(p *Person) error {
+							p.Age++
+							return nil
+						})
+					}
+					errs <- err
+				}()
+			}
+			if tt.purge {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := store.Purge(ctx, time.Now().Add(time.Second))
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = history.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, historyFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var lastEvent uint64
+			lastVersion := make(map[int]int)
+			onDisk := make(map[int][]revision)
+			for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+				var rev revision
+				err := json.Unmarshal(line, &rev)
+				if err != nil {
+					t.Fatalf("decode %s: %v", line, err)
+				}
+				// Appending keeps event order across the file; a rewrite
+				// groups by person but keeps each person's order.
+				if !tt.purge && rev.EventID <= lastEvent {
+					t.Fatalf("event %d written after event %d", rev.EventID, lastEvent)
+				}
+				lastEvent = rev.EventID
+				if prev, ok := lastVersion[rev.PersonID]; ok && rev.Version <= prev {
+					t.Fatalf("person %d: version %d written after version %d", rev.PersonID, rev.Version, prev)
+				}
+				lastVersion[rev.PersonID] = rev.Version
+				onDisk[rev.PersonID] = append(onDisk[rev.PersonID], rev)
+			}
+
+			for id, revs := range history.byID {
+				if len(onDisk[id]) != len(revs) {
+					t.Errorf("person %d: %d revisions on disk, %d in memory", id, len(onDisk[id]), len(revs))
+					continue
+				}
+				for i, rev := range revs {
+					if got := onDisk[id][i]; got.EventID != rev.EventID || got.Type != rev.Type {
+						t.Errorf("person %d revision %d: disk has event %d %s, memory %d %s", id, i, got.EventID, got.Type, rev.EventID, rev.Type)
+					}
+				}
+			}
+			if revs := onDisk[doomed.ID]; tt.purge && (len(revs) != 1 || revs[0].Type != eventPurged) {
+				t.Errorf("purged person on disk = %+v, want only the purge", revs)
+			}
+		})
+	}
+}
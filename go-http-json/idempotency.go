@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotencyKeysPerCaller bounds how many keys one caller can have
+// stored at once. Without it, a client could fill memory with unique keys
+// for a whole ttl.
+const maxIdempotencyKeysPerCaller = 1000
+
+// replayedHeaders are the stored response headers sent again on a replay.
+// They describe the representation; others, such as RateLimit-*, describe
+// the moment of the first request and would be stale.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// errIdempotencyKeysFull is returned by begin when a caller has
+// maxIdempotencyKeysPerCaller requests with a key still running.
+var errIdempotencyKeysFull = errors.New("too many idempotency keys in use")
+
+// idempotencyEntry is the stored outcome of the first request with a key.
+// While the first request is still running, done is false.
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+// idempotencyCache remembers responses by caller and Idempotency-Key for
+// ttl so that retried POSTs replay the original response instead of
+// creating duplicates.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]map[string]*idempotencyEntry // by caller, then key
+	lastSweep time.Time
+}
+
+// newIdempotencyCache returns an empty cache that keeps entries for ttl.
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:       ttl,
+		entries:   make(map[string]map[string]*idempotencyEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// begin looks up the key of caller. If there is no live entry it reserves
+// one and returns nil with reserved set; otherwise it returns the existing
+// entry (a copy). A caller at maxIdempotencyKeysPerCaller loses its
+// finished entry that expires first; if none of them has finished, begin
+// fails with errIdempotencyKeysFull.
+func (c *idempotencyCache) begin(caller, key string, fingerprint [sha256.Size]byte) (existing *idempotencyEntry, reserved bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+
+	keys := c.entries[caller]
+	e, ok := keys[key]
+	if ok && now.Before(e.expires) {
+		copied := *e
+		return &copied, false, nil
+	}
+
+	if keys == nil {
+		keys = make(map[string]*idempotencyEntry)
+		c.entries[caller] = keys
+	}
+	if !ok && len(keys) >= maxIdempotencyKeysPerCaller {
+		oldest := ""
+		for k, e := range keys {
+			if e.done && (oldest == "" || e.expires.Before(keys[oldest].expires)) {
+				oldest = k
+			}
+		}
+		if oldest == "" {
+			return nil, false, errIdempotencyKeysFull
+		}
+		delete(keys, oldest)
+	}
+	keys[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(c.ttl)}
+	return nil, true, nil
+}
+
+// finish stores the response for a reserved key. Only replayedHeaders are
+// kept.
+func (c *idempotencyCache) finish(caller, key string, status int, header http.Header, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[caller][key]
+	if !ok {
+		return
+	}
+	e.done = true
+	e.status = status
+	e.header = http.Header{}
+	for _, name := range replayedHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			e.header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	e.body = body
+	e.expires = time.Now().Add(c.ttl)
+}
+
+// release drops a reserved key so the client may retry it, e.g. after a 5xx.
+func (c *idempotencyCache) release(caller, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries[caller], key)
+	if len(c.entries[caller]) == 0 {
+		delete(c.entries, caller)
+	}
+}
+
+// sweep removes expired entries, at most a few times per ttl so that a busy
+// cache does not scan every entry on every request. The caller must hold c.mu.
+func (c *idempotencyCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < max(c.ttl/10, time.Minute) {
+		return
+	}
+	c.lastSweep = now
+	for caller, keys := range c.entries {
+		for key, e := range keys {
+			if !now.Before(e.expires) {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(c.entries, caller)
+		}
+	}
+}
+
+// idempotent wraps a POST handler with Idempotency-Key support. The first
+// response with a key is stored; retries with the same key and body replay
+// it, and retries with the same key but a different body get 422. Keys are
+// scoped to the caller, so two clients that happen to pick the same key
+// never see each other's responses.
+func (s *server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Idempotency-Key")
+		if header == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(header) > maxIdempotencyKeyLength {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidIdempotencyKey, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+		caller := actorFrom(r.Context())
+
+		// Read one byte past the limit so an oversized body still reaches
+		// decodeJSONBody and gets its usual 413, without being cached.
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidJSON, "could not read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if len(body) > maxBodyBytes {
+			next(w, r)
+			return
+		}
+
+		h := sha256.New()
+		io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+		h.Write(body)
+		var fingerprint [sha256.Size]byte
+		h.Sum(fingerprint[:0])
+
+		existing, reserved, err := s.idempotency.begin(caller, header, fingerprint)
+		if err != nil {
+			writeProblem(w, r, http.StatusTooManyRequests, codeRateLimited, "too many requests with an Idempotency-Key are still being processed")
+			return
+		}
+		if !reserved {
+			switch {
+			case existing.fingerprint != fingerprint:
+				writeProblem(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "Idempotency-Key was already used with a different request body")
+			case !existing.done:
+				writeProblem(w, r, http.StatusConflict, codeIdempotencyInProgress, "a request with this Idempotency-Key is still being processed")
+			default:
+				for name, values := range existing.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.status)
+				w.Write(existing.body)
+			}
+			return
+		}
+
+		// If next panics, free the key so a retry is not stuck "in progress".
+		finished := false
+		defer func() {
+			if !finished {
+				s.idempotency.release(caller, header)
+			}
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		finished = true
+
+		// Server errors are not final; let the client retry with the same key.
+		if rec.status >= 500 {
+			s.idempotency.release(caller, header)
+			return
+		}
+		s.idempotency.finish(caller, header, rec.status, rec.header, rec.body.Bytes())
+	}
+}
+
+// responseRecorder passes a response through to the client while keeping a
+// copy of the status, headers and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+	rec.header = rec.ResponseWriter.Header().Clone()
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyReplayHeaders(t *testing.T) {
+	c := newIdempotencyCache(time.Hour)
+	fp := sha256.Sum256([]byte("body"))
+	_, reserved, err := c.begin("alice", "k", fp)
+	if err != nil || !reserved {
+		t.Fatalf("begin = %v, %v; want a reservation", reserved, err)
+	}
+	c.finish("alice", "k", http.StatusCreated, http.Header{
+		"Content-Type":        {"application/json"},
+		"Location":            {"/people/1"},
+		"Etag":                {`"v1"`},
+		"Ratelimit-Remaining": {"7"},
+		"Retry-After":         {"1"},
+		"X-Request-Id":        {"first"},
+	}, []byte("{}"))
+
+	e, _, _ := c.begin("alice", "k", fp)
+	tests := []struct {
+		header, want string
+	}{
+		{"Content-Type", "application/json"},
+		{"Location", "/people/1"},
+		{"ETag", `"v1"`},
+		{"RateLimit-Remaining", ""},
+		{"Retry-After", ""},
+		{"X-Request-Id", ""},
+	}
+	for _, tt := range tests {
+		if got := e.header.Get(tt.header); got != tt.want {
+			t.Errorf("replayed %s = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+
+	if e, reserved, _ := c.begin("bob", "k", fp); e != nil || !reserved {
+		t.Errorf("bob sees alice's key")
+	}
+}
+
+func TestIdempotencyKeysPerCaller(t *testing.T) {
+	c := newIdempotencyCache(time.Hour)
+	fp := sha256.Sum256([]byte("body"))
+	for i := range maxIdempotencyKeysPerCaller {
+		_, _, err := c.begin("alice", strconv.Itoa(i), fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every key is still in progress, so nothing can make room.
+	_, _, err := c.begin("alice", "one more", fp)
+	if !errors.Is(err, errIdempotencyKeysFull) {
+		t.Fatalf("begin past the limit: err = %v, want errIdempotencyKeysFull", err)
+	}
+	if _, reserved, err := c.begin("bob", "k", fp); err != nil || !reserved {
+		t.Fatalf("another caller is limited too: %v", err)
+	}
+
+	// A finished entry is given up for the new key.
+	c.finish("alice", "0", http.StatusCreated, nil, nil)
+	_, reserved, err := c.begin("alice", "one more", fp)
+	if err != nil || !reserved {
+		t.Fatalf("begin after a finish = %v, %v; want a reservation", reserved, err)
+	}
+	if n := len(c.entries["alice"]); n != maxIdempotencyKeysPerCaller {
+		t.Errorf("alice has %d keys, want %d", n, maxIdempotencyKeysPerCaller)
+	}
+	if _, ok := c.entries["alice"]["0"]; ok {
+		t.Errorf("the finished key was kept")
+	}
+}
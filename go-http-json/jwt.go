@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Minimum key sizes accepted from the JWKS file.
+const (
+	minHMACKeyBytes = 32
+	minRSAKeyBits   = 2048
+)
+
+// jwk is one entry of a JSON Web Key Set (RFC 7517). Only symmetric ("oct")
+// and RSA public keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// verificationKey is a parsed JWK. Exactly one of secret and rsa is set, and
+// alg is the only algorithm the key may be used with.
+type verificationKey struct {
+	alg    string
+	secret []byte
+	rsa    *rsa.PublicKey
+}
+
+// jwtVerifier checks tokens issued by the gateway.
+type jwtVerifier struct {
+	keys     map[string]verificationKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+}
+
+// jwtClaims are the registered and scope claims the server looks at.
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *int64   `json:"exp"`
+	NotBefore *int64   `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Scp       []string `json:"scp"`
+}
+
+// scopes merges the space-separated "scope" claim (RFC 8693) and the "scp"
+// array some issuers use instead.
+func (c jwtClaims) scopes() []string {
+	return append(strings.Fields(c.Scope), c.Scp...)
+}
+
+// audience is the "aud" claim, which may be a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(data, &many)
+	if err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+	*a = many
+	return nil
+}
+
+// newJWTVerifier loads the keys in the JWKS file at path.
+func newJWTVerifier(path, issuer, aud string, leeway time.Duration) (*jwtVerifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	v := &jwtVerifier{
+		keys:     make(map[string]verificationKey),
+		issuer:   issuer,
+		audience: aud,
+		leeway:   leeway,
+	}
+	for i, k := range set.Keys {
+		key, err := parseJWK(k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: key %d (kid %q): %w", path, i, k.Kid, err)
+		}
+		if _, dup := v.keys[k.Kid]; dup {
+			return nil, fmt.Errorf("%s: duplicate kid %q", path, k.Kid)
+		}
+		v.keys[k.Kid] = key
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return v, nil
+}
+
+// parseJWK validates k and decodes its key material.
+func parseJWK(k jwk) (verificationKey, error) {
+	switch k.Kty {
+	case "oct":
+		if k.Alg != "" && k.Alg != "HS256" {
+			return verificationKey{}, fmt.Errorf("oct keys support HS256, not %s", k.Alg)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil {
+			return verificationKey{}, errors.New("k is not base64url")
+		}
+		if len(secret) < minHMACKeyBytes {
+			return verificationKey{}, fmt.Errorf("HS256 keys must be at least %d bytes", minHMACKeyBytes)
+		}
+		return verificationKey{alg: "HS256", secret: secret}, nil
+
+	case "RSA":
+		if k.Alg != "" && k.Alg != "RS256" {
+			return verificationKey{}, fmt.Errorf("RSA keys support RS256, not %s", k.Alg)
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return verificationKey{}, errors.New("n and e must be base64url big-endian integers")
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if pub.N.BitLen() < minRSAKeyBits {
+			return verificationKey{}, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+		return verificationKey{alg: "RS256", rsa: pub}, nil
+	}
+	return verificationKey{}, fmt.Errorf("unsupported kty %q", k.Kty)
+}
+
+// looksLikeJWT reports whether token has the three dot-separated parts of
+// a compact JWS, as opposed to an opaque API key.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verify checks the signature and claims of a compact JWS token and returns
+// its claims. The error text is safe to show to the client.
+func (v *jwtVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("token is not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return claims, errors.New("token header is malformed")
+	}
+
+	key, ok := v.keys[header.Kid]
+	if !ok && header.Kid == "" && len(v.keys) == 1 {
+		for _, only := range v.keys {
+			key, ok = only, true
+		}
+	}
+	if !ok {
+		return claims, fmt.Errorf("unknown key id %q", header.Kid)
+	}
+	// The algorithm comes from the key, never from the token alone, so a
+	// token cannot switch an RSA key to HMAC or to "none".
+	if header.Alg != key.alg {
+		return claims, fmt.Errorf("algorithm %q does not match the key", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("token signature is malformed")
+	}
+	signed := parts[0] + "." + parts[1]
+	if !key.verifySignature([]byte(signed), sig) {
+		return claims, errors.New("token signature is invalid")
+	}
+
+	// Only look at the claims once the signature is known to be good.
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return claims, errors.New("token claims are malformed")
+	}
+
+	switch {
+	case claims.ExpiresAt == nil:
+		return claims, errors.New("token has no exp claim")
+	case now.After(time.Unix(*claims.ExpiresAt, 0).Add(v.leeway)):
+		return claims, errors.New("token has expired")
+	case claims.NotBefore != nil && now.Add(v.leeway).Before(time.Unix(*claims.NotBefore, 0)):
+		return claims, errors.New("token is not valid yet")
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return claims, errors.New("token issuer is not accepted")
+	case v.audience != "" && !slices.Contains(claims.Audience, v.audience):
+		return claims, errors.New("token audience does not include this API")
+	case claims.Subject == "":
+		return claims, errors.New("token has no sub claim")
+	}
+	return claims, nil
+}
+
+// verifySignature checks sig over signed with the key's algorithm.
+func (k verificationKey) verifySignature(signed, sig []byte) bool {
+	switch k.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case "RS256":
+		sum := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, sum[:], sig) == nil
+	}
+	return false
+}
+
+// decodeJWTPart decodes one base64url JSON segment of a token into dst.
+func decodeJWTPart(part string, dst any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWKS holds the keys behind a JWKS file written for a test.
+type testJWKS struct {
+	path   string
+	secret []byte
+	rsa    *rsa.PrivateKey
+}
+
+// newTestJWKS writes a JWKS with one HS256 key ("hs") and one RS256 key
+// ("rs") to a temp dir.
+func newTestJWKS(t *testing.T) testJWKS {
+	t.Helper()
+	secret := make([]byte, minHMACKeyBytes)
+	rand.Read(secret)
+	priv, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := map[string][]jwk{"keys": {
+		{Kty: "oct", Kid: "hs", Alg: "HS256", K: b64(secret)},
+		{Kty: "RSA", Kid: "rs", Alg: "RS256", N: b64(priv.N.Bytes()), E: b64(big.NewInt(int64(priv.E)).Bytes())},
+	}}
+	data, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testJWKS{path: path, secret: secret, rsa: priv}
+}
+
+// sign returns a compact JWS with the given header alg and kid, signed with
+// the matching test key.
+func (k testJWKS) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sum := sha256.Sum256([]byte(signed))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newTestJWKS(t)
+	v, err := newJWTVerifier(keys.path, "https://gateway", "people-api", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_800_000_000, 0)
+
+	// claims returns valid claims with the given overrides; a nil value
+	// removes the claim.
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":   "https://gateway",
+			"sub":   "alice",
+			"aud":   []string{"other", "people-api"},
+			"exp":   now.Add(time.Minute).Unix(),
+			"scope": "people:read people:write",
+		}
+		for k, val := range overrides {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"HS256", keys.sign(t, "HS256", "hs", claims(nil)), ""},
+		{"RS256", keys.sign(t, "RS256", "rs", claims(nil)), ""},
+		{"string aud", keys.sign(t, "HS256", "hs", claims(map[string]any{"aud": "people-api"})), ""},
+		{"expired within leeway", keys.sign(t, "HS256", "hs", claims(map[string]any{"exp": now.Add(-20 * time.Second).Unix()})), ""},
+		{"expired", keys.sign(t, "HS256", "hs", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), "expired"},
+		{"no exp", keys.sign(t, "HS256", "hs", claims(map[string]any{"exp": nil})), "no exp"},
+		{"not yet valid", keys.sign(t, "HS256", "hs", claims(map[string]any{"nbf": now.Add(time.Minute).Unix()})), "not valid yet"},
+		{"wrong issuer", keys.sign(t, "HS256", "hs", claims(map[string]any{"iss": "https://evil"})), "issuer"},
+		{"wrong audience", keys.sign(t, "HS256", "hs", claims(map[string]any{"aud": "billing"})), "audience"},
+		{"no subject", keys.sign(t, "HS256", "hs", claims(map[string]any{"sub": nil})), "no sub"},
+		{"unknown kid", keys.sign(t, "HS256", "nope", claims(nil)), "unknown key id"},
+		{"alg switched to HMAC", keys.sign(t, "HS256", "rs", claims(nil)), "does not match the key"},
+		{"alg none", strings.TrimSuffix(keys.sign(t, "none", "hs", claims(nil)), "."), "not a JWT"},
+		{"alg none with empty signature", keys.sign(t, "none", "hs", claims(nil)), "does not match the key"},
+		{"tampered claims", tamper(keys.sign(t, "HS256", "hs", claims(nil))), "signature is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.verify(tt.token, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				if got.Subject != "alice" {
+					t.Fatalf("subject = %q, want alice", got.Subject)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tamper swaps the claims of token for ones granting admin, keeping the
+// original signature.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "scope": scopeAdmin})
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func TestJWTScopes(t *testing.T) {
+	keys := newTestJWKS(t)
+	v, err := newJWTVerifier(keys.path, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, testConfig(t))
+	s.jwt = v
+	h := s.handler()
+
+	exp := time.Now().Add(time.Minute).Unix()
+	reader := keys.sign(t, "RS256", "rs", map[string]any{"sub": "r", "exp": exp, "scope": scopeRead})
+	writer := keys.sign(t, "RS256", "rs", map[string]any{"sub": "w", "exp": exp, "scp": []string{scopeRead, scopeWrite}})
+
+	tests := []struct {
+		name, method, token string
+		want                int
+	}{
+		{"no token", http.MethodGet, "", http.StatusUnauthorized},
+		{"read scope can list", http.MethodGet, reader, http.StatusOK},
+		{"read scope cannot create", http.MethodPost, reader, http.StatusForbidden},
+		{"write scope can create", http.MethodPost, writer, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/v1/people", strings.NewReader(`{"name":"Eve","age":28}`))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -1,24 +1,279 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // Person represents a simple data model for JSON input/output.
 type Person struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-	Age  int    `json:"age"`
+	ID   int    `json:"id" validate:"required,readonly,min=1"`
+	Name string `json:"name" validate:"required,minlen=1,maxlen=100"`
+	Age  int    `json:"age" validate:"required,min=1,max=150"`
+
+	// Contact details, only visible through /v2.
+	Email   string   `json:"email,omitempty" validate:"maxlen=254"`
+	Phone   string   `json:"phone,omitempty" validate:"pattern=phone"`
+	Tags    []string `json:"tags,omitempty" validate:"maxitems=20,maxlen=32,pattern=tag"`
+	Address *Address `json:"address,omitempty"`
+
+	// CreatedAt and UpdatedAt are set by the store. People stored before
+	// they existed have none.
+	CreatedAt time.Time `json:"created_at,omitzero" validate:"readonly"`
+	UpdatedAt time.Time `json:"updated_at,omitzero" validate:"readonly"`
+
+	// DeletedAt is set while the person is soft-deleted. Such tombstones
+	// are only visible through ?include_deleted=true and restore.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" validate:"readonly"`
+
+	// Version starts at 1 and is bumped by the store on every update.
+	// It is exposed only through the ETag header, not the JSON body.
+	Version int `json:"-"`
 }
 
-// In-memory storage for Person records.
-var (
-	people []Person
-	nextID = 1
-)
+// server holds the dependencies shared by the handlers.
+type server struct {
+	cfg          config
+	store        PersonStore
+	idempotency  *idempotencyCache
+	apiKeys      *apiKeySet
+	jwt          *jwtVerifier
+	metrics      *httpMetrics
+	health       health
+	events       *eventBroker
+	webhooks     *webhookDispatcher
+	history      *historyLog
+	readLimiter  *rateLimiter
+	writeLimiter *rateLimiter
+}
+
+// newServer returns a server backed by the given store. The store is
+// wrapped so that every change is published to the event feed, to
+// webhooks and to the revision history.
+func newServer(cfg config, store PersonStore, webhooks *webhookDispatcher, history *historyLog) *server {
+	events := newEventBroker(cfg.EventsBuffer)
+	return &server{
+		cfg:          cfg,
+		store:        newEventingStore(store, events, webhooks, history),
+		events:       events,
+		webhooks:     webhooks,
+		history:      history,
+		idempotency:  newIdempotencyCache(cfg.IdempotencyTTL),
+		metrics:      newHTTPMetrics(),
+		readLimiter:  newRateLimiter(cfg.ReadRate, cfg.ReadBurst),
+		writeLimiter: newRateLimiter(cfg.WriteRate, cfg.WriteBurst),
+	}
+}
+
+// routes registers every handler, together with the operations it serves,
+// on a new router. The operations are what /openapi.json is built from.
+func (s *server) routes() *router {
+	rt := newRouter()
+
+	rt.handle("/", notFoundHandler)
+	rt.handle("/status", statusHandler, operation{
+		method: http.MethodGet, id: "getStatus", summary: "Static status check", public: true,
+		responses: []apiResponse{{status: http.StatusOK, body: map[string]string{}}},
+	})
+	rt.handle("/metrics", s.metricsHandler, operation{
+		method: http.MethodGet, id: "getMetrics", summary: "Prometheus metrics", public: true,
+		responses: []apiResponse{{status: http.StatusOK, body: "", mediaTypes: []string{"text/plain"}}},
+	})
+	rt.handle("/livez", s.probeHandler(s.livenessChecks), operation{
+		method: http.MethodGet, id: "livez", summary: "Liveness probe", public: true,
+		params:    []param{verboseParam},
+		responses: []apiResponse{{status: http.StatusOK, body: healthReport{}}, {status: http.StatusServiceUnavailable, body: healthReport{}}},
+	})
+	rt.handle("/readyz", s.probeHandler(s.readinessChecks), operation{
+		method: http.MethodGet, id: "readyz", summary: "Readiness probe", public: true,
+		params:    []param{verboseParam},
+		responses: []apiResponse{{status: http.StatusOK, body: healthReport{}}, {status: http.StatusServiceUnavailable, body: healthReport{}}},
+	})
+	rt.handle("/openapi.json", openAPIHandler(rt), operation{
+		method: http.MethodGet, id: "getOpenAPI", summary: "This OpenAPI document", public: true,
+		responses: []apiResponse{{status: http.StatusOK, body: map[string]any{}}},
+	})
+
+	rt.handle("/admin/webhooks", s.webhooksHandler, operation{
+		method: http.MethodGet, id: "listWebhooks", summary: "List webhook subscriptions (secrets are not shown)",
+		responses: []apiResponse{{status: http.StatusOK, body: []webhook{}}},
+	}, operation{
+		method: http.MethodPost, id: "createWebhook", summary: "Subscribe a URL to person changes",
+		request:   createWebhookRequest{},
+		responses: []apiResponse{{status: http.StatusCreated, body: webhook{}}},
+		problems:  []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType},
+	})
+	rt.handle("/admin/webhooks/{id}", s.webhookHandler, operation{
+		method: http.MethodDelete, id: "deleteWebhook", summary: "Delete a webhook and its pending deliveries",
+		responses: []apiResponse{{status: http.StatusNoContent}},
+		problems:  []int{http.StatusNotFound},
+	})
+	rt.handle("/admin/webhooks/dead-letters", s.deadLettersHandler, operation{
+		method: http.MethodGet, id: "listWebhookDeadLetters", summary: "List deliveries that ran out of attempts",
+		responses: []apiResponse{{status: http.StatusOK, body: []webhookDelivery{}}},
+	})
+	rt.handle("/admin/webhooks/dead-letters/{id}/retry", s.retryDeadLetterHandler, operation{
+		method: http.MethodPost, id: "retryWebhookDeadLetter", summary: "Queue a dead letter again",
+		responses: []apiResponse{{status: http.StatusAccepted, body: webhookDelivery{}}},
+		problems:  []int{http.StatusNotFound},
+	})
+
+	rt.handle("/rpc", s.rpcHandler, operation{
+		method: http.MethodPost, id: "callRPC", summary: "JSON-RPC 2.0 calls to people.list, get, create, update, delete and stats; send an array for a batch",
+		request:   rpcRequest{},
+		responses: []apiResponse{{status: http.StatusOK, body: rpcResponse{}}, {status: http.StatusNoContent}},
+		problems:  []int{http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType},
+	})
+
+	s.peopleRoutes(rt, "/v1", apiV1)
+	s.peopleRoutes(rt, "/v2", apiV2)
+	// The unversioned paths predate versioning and stay as aliases of v1.
+	s.peopleRoutes(rt, "", apiV1)
+
+	return rt
+}
+
+// peopleSchemas are the request and response bodies of one API version,
+// for the OpenAPI document. view, page and event are the bodies that
+// ?fields= and ?include= can shape.
+type peopleSchemas struct {
+	person, view, page, create, bulk, update, event, revisions any
+}
+
+// peopleRoutes registers the people API under prefix for version v. v2
+// operation IDs get a V2 suffix and v1 operations are marked deprecated.
+// The unversioned aliases use an empty prefix and are left out of the
+// OpenAPI document.
+func (s *server) peopleRoutes(rt *router, prefix string, v apiVersion) {
+	sch := peopleSchemas{personV1{}, projected[personV1]{}, projected[peoplePageV1]{}, createPersonRequest{}, []createPersonRequest{}, updatePersonRequest{}, projected[changeEventV1]{}, []revisionV1{}}
+	if v == apiV2 {
+		sch = peopleSchemas{Person{}, projected[Person]{}, projected[peoplePage]{}, createPersonRequestV2{}, []createPersonRequestV2{}, updatePersonRequestV2{}, projected[changeEvent]{}, []revision{}}
+	}
+	handle := func(pattern string, h http.HandlerFunc, ops ...operation) {
+		if prefix == "" {
+			ops = nil
+		}
+		for i := range ops {
+			ops[i].deprecated = v == apiV1
+			if v == apiV2 {
+				ops[i].id += "V2"
+			}
+		}
+		rt.handle(prefix+pattern, s.versioned(v, h), ops...)
+	}
+
+	createPerson := s.idempotent(s.createPersonHandler)
+	handle("/people", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.listPeopleHandler(w, r)
+		case http.MethodPost:
+			createPerson(w, r)
+		default:
+			writeMethodNotAllowed(w, r, "GET, POST")
+		}
+	}, operation{
+		method: http.MethodGet, id: "listPeople", summary: "List people, one page at a time",
+		params: listParams,
+		responses: []apiResponse{{
+			status: http.StatusOK, body: sch.page,
+			mediaTypes: []string{mediaJSON, formatMediaTypes[formatNDJSON], formatMediaTypes[formatCSV]},
+		}},
+		problems: []int{http.StatusBadRequest, http.StatusNotAcceptable},
+	}, operation{
+		method: http.MethodPost, id: "createPerson", summary: "Create a person",
+		params:    []param{{in: "header", name: "Idempotency-Key", typ: "string", description: "Replays the first response for retries with the same key and body."}},
+		request:   sch.create,
+		responses: []apiResponse{{status: http.StatusCreated, body: sch.person}},
+		problems:  []int{http.StatusBadRequest, http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity},
+	})
+	handle("/people/bulk", s.bulkCreatePeopleHandler, operation{
+		method: http.MethodPost, id: "bulkCreatePeople", summary: "Import people from a JSON array or NDJSON stream",
+		params:    []param{{in: "query", name: "mode", typ: "string", description: "atomic (default) or best_effort."}},
+		request:   sch.bulk,
+		reqTypes:  []string{mediaJSON, formatMediaTypes[formatNDJSON]},
+		responses: []apiResponse{{status: http.StatusOK, body: bulkReport{}}, {status: http.StatusCreated, body: bulkReport{}}, {status: http.StatusUnprocessableEntity, body: bulkReport{}}},
+		problems:  []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType},
+	})
+
+	handle("/people/events", s.peopleEventsHandler, operation{
+		method: http.MethodGet, id: "streamPeopleEvents", summary: "Server-Sent Events feed of created, updated and deleted people",
+		params:    []param{{in: "header", name: "Last-Event-ID", typ: "integer", description: "Resume after this event; sent automatically by EventSource."}, fieldsParam, includeParam},
+		responses: []apiResponse{{status: http.StatusOK, body: sch.event, mediaTypes: []string{mediaEventStream}}},
+		problems:  []int{http.StatusBadRequest},
+	})
+
+	personResponses := []apiResponse{{status: http.StatusOK, body: sch.person}}
+	ifMatch := param{in: "header", name: "If-Match", typ: "string", description: "Only apply the change if the ETag still matches."}
+	updateProblems := []int{http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusPreconditionFailed, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType}
+	handle("/people/{id}/history", s.personHistoryHandler, operation{
+		method: http.MethodGet, id: "getPersonHistory", summary: "Every revision of a person, oldest first, including deleted people",
+		responses: []apiResponse{{status: http.StatusOK, body: sch.revisions}},
+		problems:  []int{http.StatusNotFound},
+	})
+	handle("/people/{id}/restore", s.restorePersonHandler, operation{
+		method: http.MethodPost, id: "restorePerson", summary: "Undo the deletion of a person that has not been purged yet",
+		responses: personResponses,
+		problems:  []int{http.StatusNotFound, http.StatusConflict},
+	})
+	handle("/people/{id}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			s.getPersonHandler(w, r)
+		case http.MethodPut, http.MethodPatch:
+			s.updatePersonHandler(w, r)
+		case http.MethodDelete:
+			s.deletePersonHandler(w, r)
+		default:
+			writeMethodNotAllowed(w, r, "GET, PUT, PATCH, DELETE")
+		}
+	}, operation{
+		method: http.MethodGet, id: "getPerson", summary: "Get a person",
+		params:    []param{{in: "header", name: "If-None-Match", typ: "string", description: "Answer 304 if the ETag still matches."}, asOfParam, fieldsParam, includeParam},
+		responses: []apiResponse{{status: http.StatusOK, body: sch.view}, {status: http.StatusNotModified}},
+		problems:  []int{http.StatusBadRequest, http.StatusNotFound},
+	}, operation{
+		method: http.MethodPut, id: "replacePerson", summary: "Replace a person",
+		params: []param{ifMatch}, request: sch.update, responses: personResponses, problems: updateProblems,
+	}, operation{
+		method: http.MethodPatch, id: "updatePerson", summary: "Change some fields of a person",
+		params: []param{ifMatch}, request: sch.update, responses: personResponses, problems: updateProblems,
+	}, operation{
+		method: http.MethodDelete, id: "deletePerson", summary: "Soft-delete a person; it can be restored until purged",
+		params:    []param{ifMatch},
+		responses: []apiResponse{{status: http.StatusNoContent}},
+		problems:  []int{http.StatusNotFound, http.StatusPreconditionFailed},
+	})
+}
+
+// handler returns the routes wrapped in the middleware chain: request IDs
+// first, so every log line and problem carries one, then the access log and
+// metrics, then panic recovery, so a recovered panic is still logged and
+// counted as a 500. Failed logins are rate limited by IP before auth, so
+// guessing keys is throttled; authenticated requests are then limited after
+// auth, so each API key or JWT subject gets its own budget.
+func (s *server) handler() http.Handler {
+	mux := s.routes().mux
+	return chain(mux, withRequestID, withAccessLog, s.withMetrics(mux), withRecover, s.withAuthFailureLimit, s.withAuth, s.withRateLimit)
+}
+
+// notFoundHandler answers every path that no other route matches.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, codeNotFound, "no route for "+r.URL.Path)
+}
 
 // statusHandler returns a simple JSON status.
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -31,91 +286,481 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := json.NewEncoder(w).Encode(status)
 	if err != nil {
-		log.Println("error encoding status response:", err)
+		slog.ErrorContext(r.Context(), "error encoding status response", "err", err)
 	}
 }
 
-// listPeopleHandler returns all people as JSON.
-func listPeopleHandler(w http.ResponseWriter, r *http.Request) {
+// listPeopleHandler returns one page of people. The format is negotiated
+// from ?format= or Accept (see negotiateFormat): a JSON envelope with a next
+// link by default, or NDJSON or CSV rows for exports. JSON pages default to
+// defaultPageLimit people, while NDJSON and CSV export every match unless
+// ?limit= is given. See parseListQuery for filters and sorting.
+func (s *server) listPeopleHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, http.MethodGet)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Vary", "Accept")
+	format, ok := negotiateFormat(r)
+	if !ok {
+		writeProblem(w, r, http.StatusNotAcceptable, codeNotAcceptable, "supported formats are application/json, application/x-ndjson and text/csv")
+		return
+	}
+
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	if format != formatJSON && !q.limitSet {
+		q.limit = math.MaxInt
+	}
+	pr, err := parseProjection(r.URL.Query(), apiVersionFrom(r.Context()))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	asOf, pointInTime, err := parseAsOf(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	people, err := s.loadPeople(r.Context(), asOf, pointInTime, q.includeDeleted)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	page, next := q.page(people)
+	nextURL := ""
+	if next != nil {
+		nextURL = nextPageURL(r.URL, *next)
+	}
 
-	err := json.NewEncoder(w).Encode(people)
+	err = writePeople(w, format, pr, page, nextURL)
 	if err != nil {
-		log.Println("error encoding people list:", err)
+		slog.ErrorContext(r.Context(), "error writing people list", "err", err)
 	}
 }
 
+// loadPeople returns everyone a list query starts from: the live people,
+// plus tombstones with includeDeleted, or with pointInTime the people as of
+// asOf from the revision history.
+func (s *server) loadPeople(ctx context.Context, asOf time.Time, pointInTime, includeDeleted bool) ([]Person, error) {
+	if pointInTime {
+		return s.history.peopleAt(asOf, includeDeleted), nil
+	}
+	people, err := s.store.List(ctx)
+	if err != nil || !includeDeleted {
+		return people, err
+	}
+	deleted, err := s.store.ListDeleted(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(people, deleted...), nil
+}
+
+// Address is a postal address. Every line is optional.
+type Address struct {
+	Street     string `json:"street,omitempty" validate:"maxlen=200"`
+	City       string `json:"city,omitempty" validate:"maxlen=200"`
+	PostalCode string `json:"postal_code,omitempty" validate:"maxlen=200"`
+	Country    string `json:"country,omitempty" validate:"pattern=country"` // ISO 3166-1 alpha-2
+}
+
+// orNil returns nil for a nil or empty address, so {} clears it.
+func (a *Address) orNil() *Address {
+	if a == nil || *a == (Address{}) {
+		return nil
+	}
+	return a
+}
+
 // createPersonRequest represents the expected JSON body for creating a person.
 type createPersonRequest struct {
-	Name string `json:"name"`
-	Age  int    `json:"age"`
+	Name string `json:"name" validate:"required,minlen=1,maxlen=100"`
+	Age  int    `json:"age" validate:"required,min=1,max=150"`
 }
 
 // createPersonHandler reads JSON body, creates a new Person, and returns it.
-func createPersonHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) createPersonHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r, http.MethodPost)
 		return
 	}
 
-	var req createPersonRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	req := newPersonCreate(apiVersionFrom(r.Context()))
+	err := decodeJSONBody(w, r, req)
 	if err != nil {
-		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		writeRequestError(w, r, err)
+		return
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
 		return
 	}
 
-	if req.Name == "" || req.Age <= 0 {
-		http.Error(w, "name and age must be provided and valid", http.StatusBadRequest)
+	person, err := s.store.Create(r.Context(), req.person())
+	if err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
-	person := Person{
-		ID:   nextID,
-		Name: req.Name,
-		Age:  req.Age,
+	w.Header().Set("Location", fmt.Sprintf("%s/people/%d", versionPrefix(r), person.ID))
+	writePerson(w, r, http.StatusCreated, person)
+}
+
+// updatePersonRequest represents the JSON body for PUT and PATCH on /people/{id}.
+// Fields are pointers so PATCH can tell a missing field from a zero value.
+// ID is optional; when present it must match the ID in the URL.
+type updatePersonRequest struct {
+	ID   *int    `json:"id" validate:"min=1"`
+	Name *string `json:"name" validate:"minlen=1,maxlen=100"`
+	Age  *int    `json:"age" validate:"min=1,max=150"`
+}
+
+// personIDFromPath parses the {id} path value. It writes a 404 and returns
+// false when the value is not a positive integer.
+func personIDFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "person "+r.PathValue("id")+" not found")
+		return 0, false
 	}
-	nextID++
-	people = append(people, person)
+	return id, true
+}
 
+// writePerson encodes a single person in the request's API version with the
+// given status code, along with the ETag of its current version.
+func writePerson(w http.ResponseWriter, r *http.Request, status int, person Person) {
+	writeProjectedPerson(w, status, projection{version: apiVersionFrom(r.Context())}, person)
+}
+
+// writeProjectedPerson is writePerson for a response shaped by ?fields= or
+// ?include=, with the ETag of that representation.
+func writeProjectedPerson(w http.ResponseWriter, status int, pr projection, person Person) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.Header().Set("ETag", projectedETag(pr, person))
+	w.WriteHeader(status)
 
-	err = json.NewEncoder(w).Encode(person)
+	err := json.NewEncoder(w).Encode(pr.person(person))
 	if err != nil {
-		log.Println("error encoding created person:", err)
+		slog.Error("error encoding person", "err", err)
 	}
 }
 
-func main() {
-	// Preload some in-memory data.
-	people = append(people, Person{ID: nextID, Name: "Alice", Age: 30})
-	nextID++
-	people = append(people, Person{ID: nextID, Name: "Bob", Age: 25})
-	nextID++
-
-	http.HandleFunc("/status", statusHandler)
-	http.HandleFunc("/people", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			listPeopleHandler(w, r)
-		case http.MethodPost:
-			createPersonHandler(w, r)
-		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error encoding response", "err", err)
+	}
+}
+
+// writeStoreError maps a PersonStore error to a problem response.
+// Unexpected errors are logged and hidden from the client.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errPersonNotFound) {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "person not found")
+		return
+	}
+	if errors.Is(err, errNotDeleted) {
+		writeProblem(w, r, http.StatusConflict, codeNotDeleted, "person is not deleted")
+		return
+	}
+	if errors.Is(err, errPreconditionFailed) {
+		writeProblem(w, r, http.StatusPreconditionFailed, codePreconditionFailed, "If-Match does not match the current version")
+		return
+	}
+	slog.ErrorContext(r.Context(), "store error", "err", err)
+	writeProblem(w, r, http.StatusInternalServerError, codeInternal, "")
+}
+
+// getPersonHandler returns a single person by ID, or with ?as_of= the
+// person as it was at that time.
+func (s *server) getPersonHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := personIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	asOf, pointInTime, err := parseAsOf(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+	pr, err := parseProjection(r.URL.Query(), apiVersionFrom(r.Context()))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidQuery, err.Error())
+		return
+	}
+
+	var person Person
+	if pointInTime {
+		person, err = s.history.personAt(id, asOf)
+	} else {
+		person, err = s.store.Get(r.Context(), id)
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	etag := projectedETag(pr, person)
+	if notModified(r, etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeProjectedPerson(w, http.StatusOK, pr, person)
+}
+
+// updatePersonHandler handles PUT (full replace) and PATCH (partial update).
+func (s *server) updatePersonHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := personIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	req := newPersonUpdate(apiVersionFrom(r.Context()))
+	err := decodeJSONBody(w, r, req)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+
+	if bodyID := req.bodyID(); bodyID != nil && *bodyID != id {
+		writeProblem(w, r, http.StatusConflict, codeIDMismatch, "id in body does not match id in URL")
+		return
+	}
+
+	// PUT replaces the whole resource, so name and age are required.
+	put := r.Method == http.MethodPut
+	errs := req.validate(put)
+	if len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	person, err := s.store.Update(r.Context(), id, func(p *Person) error {
+		err := checkIfMatch(r, *p)
+		if err != nil {
+			return err
 		}
+		req.apply(p, put)
+		return nil
 	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writePerson(w, r, http.StatusOK, person)
+}
+
+// deletePersonHandler removes a person by ID.
+func (s *server) deletePersonHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := personIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := s.store.Delete(r.Context(), id, func(p Person) error {
+		return checkIfMatch(r, p)
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// openStore returns a file-backed store when dataDir is set, otherwise an
+// in-memory one. A new store is preloaded with some sample data.
+func openStore(dataDir string) (PersonStore, error) {
+	var store PersonStore = newMemoryStore()
+	existed := false
+
+	if dataDir != "" {
+		fileStore, ok, err := openFileStore(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		store, existed = fileStore, ok
+	}
+	if existed {
+		return store, nil
+	}
+
+	ctx := context.Background()
+	for _, p := range []Person{{Name: "Alice", Age: 30}, {Name: "Bob", Age: 25}} {
+		_, err := store.Create(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("config error: ", err)
+	}
+
+	if cfg.DumpOpenAPI != "" {
+		err = dumpOpenAPI(cfg, cfg.DumpOpenAPI)
+		if err != nil {
+			log.Fatal("dump OpenAPI: ", err)
+		}
+		return
+	}
+
+	slog.SetDefault(slog.New(contextLogHandler{slog.NewJSONHandler(os.Stdout, nil)}))
+
+	err = run(cfg)
+	if err != nil {
+		log.Fatal("server error: ", err)
+	}
+}
+
+// run serves HTTP until SIGINT or SIGTERM, then stops accepting connections,
+// waits up to cfg.ShutdownTimeout for in-flight requests and closes the store.
+func run(cfg config) error {
+	keys, err := loadAPIKeys(cfg.APIKeys, cfg.APIKeyFile)
+	if err != nil {
+		return fmt.Errorf("load API keys: %w", err)
+	}
+	var jwt *jwtVerifier
+	if cfg.JWKSFile != "" {
+		jwt, err = newJWTVerifier(cfg.JWKSFile, cfg.JWTIssuer, cfg.JWTAudience, cfg.JWTLeeway)
+		if err != nil {
+			return fmt.Errorf("load JWKS: %w", err)
+		}
+	}
+	if !keys.enabled() && jwt == nil {
+		slog.Warn("no API keys or JWKS configured; authentication is disabled")
+	}
 
-	port := 8080
-	fmt.Println("Starting server on port", port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	store, err := openStore(cfg.DataDir)
 	if err != nil {
-		log.Fatal("server error:", err)
+		return fmt.Errorf("open store: %w", err)
+	}
+
+	webhooks, err := openWebhookDispatcher(cfg)
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("open webhooks: %w", err)
+	}
+	history, err := openHistoryLog(cfg.DataDir)
+	if err != nil {
+		webhooks.close()
+		store.Close()
+		return fmt.Errorf("open history: %w", err)
+	}
+	err = history.seed(context.Background(), store)
+	if err != nil {
+		closeAll(webhooks, history, store)
+		return fmt.Errorf("seed history: %w", err)
+	}
+
+	s := newServer(cfg, store, webhooks, history)
+	s.apiKeys = keys
+	s.jwt = jwt
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           s.handler(),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	srv.RegisterOnShutdown(s.events.close)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Listen before serving so /readyz only reports started once the port
+	// is actually bound.
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return errors.Join(err, closeAll(webhooks, history, store))
+	}
+	s.health.started.Store(true)
+	webhooks.start()
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	purgeDone := make(chan struct{})
+	go s.purgeTombstones(purgeCtx, purgeDone)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "addr", ln.Addr().String())
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err = <-serveErr:
+		// Serve only returns early on failure. Shut down the same way as
+		// after a signal, so pending deliveries and history are not lost.
+		stopPurge()
+		<-purgeDone
+		return errors.Join(err, closeAll(webhooks, history, store))
+	case <-ctx.Done():
+	}
+	// A second signal now kills the process instead of waiting for the drain.
+	stop()
+
+	// Fail readiness first and keep serving for a moment, so load balancers
+	// stop sending new traffic before the listener closes.
+	s.health.draining.Store(true)
+	if cfg.ShutdownDelay > 0 {
+		slog.Info("marked not ready, waiting before shutdown", "delay", cfg.ShutdownDelay.String())
+		time.Sleep(cfg.ShutdownDelay)
+	}
+
+	slog.Info("shutting down, draining connections", "timeout", cfg.ShutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	shutdownErr := srv.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		shutdownErr = fmt.Errorf("drain connections: %w", shutdownErr)
+	}
+
+	// Stop the purge job before the sinks it reports to. Then save webhook
+	// state and flush the store, even if the drain timed out.
+	stopPurge()
+	<-purgeDone
+	return errors.Join(shutdownErr, closeAll(webhooks, history, store))
+}
+
+// closeAll saves the webhook state, flushes the history and closes the
+// store, in that order, and returns all of their errors. Every way out of
+// run goes through it once the three are open.
+func closeAll(webhooks *webhookDispatcher, history *historyLog, store PersonStore) error {
+	webhookErr := webhooks.close()
+	if webhookErr != nil {
+		webhookErr = fmt.Errorf("close webhooks: %w", webhookErr)
+	}
+	historyErr := history.Close()
+	if historyErr != nil {
+		historyErr = fmt.Errorf("close history: %w", historyErr)
+	}
+	closeErr := store.Close()
+	if closeErr != nil {
+		closeErr = fmt.Errorf("close store: %w", closeErr)
 	}
+	return errors.Join(webhookErr, historyErr, closeErr)
 }
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdminKey is the API key that enableAdmin accepts. serve sends it with
+// every request; servers without keys ignore it.
+const testAdminKey = "test-admin-key"
+
+// enableAdmin turns authentication on for s, with testAdminKey as its only
+// key, so the admin API is reachable.
+func enableAdmin(t *testing.T, s *server) {
+	t.Helper()
+	keys, err := loadAPIKeys("admin:"+testAdminKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.apiKeys = keys
+}
+
+// testConfig returns the default config with rate limiting off.
+func testConfig(t *testing.T) config {
+	t.Helper()
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ReadRate, cfg.WriteRate = 0, 0
+	return cfg
+}
+
+// newTestServer returns a server over an empty store, with the webhook
+// dispatcher and history wired up the way run does. Everything is closed
+// when the test ends.
+func newTestServer(t *testing.T, cfg config) *server {
+	t.Helper()
+	store, err := openStore(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks, err := openWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := openHistoryLog(cfg.DataDir)
+	if err == nil {
+		err = history.seed(t.Context(), store)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.start()
+	t.Cleanup(func() {
+		webhooks.close()
+		history.Close()
+		store.Close()
+	})
+	return newServer(cfg, store, webhooks, history)
+}
+
+func TestProjection(t *testing.T) {
+	h := newTestServer(t, testConfig(t)).handler()
+	w := serve(t, h, http.MethodPost, "/v2/people", `{"name":"ada king lovelace","age":36,"email":"ada@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create person: %d %s", w.Code, w.Body)
+	}
+	path := w.Header().Get("Location")
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"?fields=name", `{"name":"ada king lovelace"}`},
+		{"?fields=age,name", `{"name":"ada king lovelace","age":36}`},
+		{"?fields=email&include=initials", `{"email":"ada@example.com","initials":"AKL"}`},
+		{"?fields=age&include=initials,age_group", `{"age":36,"age_group":"adult","initials":"AKL"}`},
+		{"?fields=phone", `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := serve(t, h, http.MethodGet, path+tt.query, "")
+			if got := strings.TrimSpace(w.Body.String()); w.Code != http.StatusOK || got != tt.want {
+				t.Fatalf("GET %s = %d %s, want %s", tt.query, w.Code, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProjectionEncodingError(t *testing.T) {
+	saved := computedFields
+	t.Cleanup(func() { computedFields = saved })
+	computedFields = append(slices.Clone(saved), computedField{"broken", func(Person) any { return make(chan int) }, nil})
+
+	pr, err := newProjection(apiV2, []string{"id"}, []string{"broken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(pr.person(Person{ID: 1, Name: "Ada", Age: 36}))
+	if err == nil {
+		t.Fatalf("encoded %s, want an error", data)
+	}
+	_, err = formatSSE(pr, changeEvent{ID: 1, Type: eventCreated, Person: Person{ID: 1}})
+	if err == nil {
+		t.Fatal("formatSSE encoded a broken event")
+	}
+}
+
+func TestRunClosesEverythingWhenListenFails(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	cfg := testConfig(t)
+	cfg.Addr = busy.Addr().String()
+	cfg.DataDir = t.TempDir()
+	err = run(cfg)
+	if err == nil {
+		t.Fatal("run succeeded on a busy port")
+	}
+
+	// The baselines seeded at start only reach the file when the history
+	// writer is closed properly.
+	data, err := os.ReadFile(filepath.Join(cfg.DataDir, historyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"type":"baseline"`)) {
+		t.Fatalf("%s holds no baseline revisions:\n%s", historyFileName, data)
+	}
+}
+
+func TestEventBrokerResume(t *testing.T) {
+	b := newEventBroker(3)
+	for id := uint64(1); id <= 5; id++ {
+		b.publish(changeEvent{ID: id, Type: eventCreated})
+	}
+
+	tests := []struct {
+		name         string
+		lastID       uint64
+		resume       bool
+		wantMissed   []uint64
+		wantComplete bool
+	}{
+		{"new stream", 0, false, nil, true},
+		{"up to date", 5, true, nil, true},
+		{"one behind", 4, true, []uint64{5}, true},
+		{"oldest stored is next", 2, true, []uint64{3, 4, 5}, true},
+		{"older than the ring", 1, true, []uint64{3, 4, 5}, false},
+		{"from the future", 9, true, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, missed, complete := b.subscribe(tt.lastID, tt.resume)
+			defer b.unsubscribe(sub)
+			var ids []uint64
+			for _, ev := range missed {
+				ids = append(ids, ev.ID)
+			}
+			if !slices.Equal(ids, tt.wantMissed) || complete != tt.wantComplete {
+				t.Fatalf("missed %v, complete %v; want %v, %v", ids, complete, tt.wantMissed, tt.wantComplete)
+			}
+		})
+	}
+}
+
+func TestEventBrokerDropsSlowSubscriber(t *testing.T) {
+	b := newEventBroker(10)
+	slow, _, _ := b.subscribe(0, false)
+	fast, _, _ := b.subscribe(0, false)
+	for id := uint64(1); id <= subscriberBuffer+1; id++ {
+		b.publish(changeEvent{ID: id})
+		<-fast.events
+	}
+
+	select {
+	case <-slow.gone:
+	default:
+		t.Fatal("a subscriber with a full queue was not dropped")
+	}
+	select {
+	case <-fast.gone:
+		t.Fatal("a subscriber that keeps up was dropped")
+	default:
+	}
+	b.close()
+	<-fast.gone
+}
+
+// sseStream reads a Server-Sent Events response one message at a time.
+type sseStream struct {
+	resp *http.Response
+	r    *bufio.Reader
+}
+
+// openSSE starts a stream from srv at path, resuming after lastID if it is
+// not empty. The stream is closed when the test ends.
+func openSSE(t *testing.T, srv *httptest.Server, path, lastID string) *sseStream {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != mediaEventStream {
+		t.Fatalf("GET %s: %s %s", path, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	return &sseStream{resp: resp, r: bufio.NewReader(resp.Body)}
+}
+
+// next returns the lines of the next message, without the blank line that
+// ends it.
+func (s *sseStream) next(t *testing.T) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// nextEvent skips retry hints and heartbeats and returns the fields of the
+// next event.
+func (s *sseStream) nextEvent(t *testing.T) map[string]string {
+	t.Helper()
+	for {
+		fields := map[string]string{}
+		for _, line := range s.next(t) {
+			name, value, _ := strings.Cut(line, ": ")
+			fields[name] = value
+		}
+		if _, ok := fields["event"]; ok {
+			return fields
+		}
+	}
+}
+
+func TestPeopleEventsStream(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.EventsHeartbeat = 20 * time.Millisecond
+	srv := httptest.NewServer(newTestServer(t, cfg).handler())
+	// Registered first so it runs last, once the streams are closed.
+	t.Cleanup(srv.Close)
+
+	stream := openSSE(t, srv, "/v2/people/events", "")
+	if got := stream.next(t); !slices.Equal(got, []string{"retry: 3000"}) {
+		t.Fatalf("first message = %q, want the retry hint", got)
+	}
+	if got := stream.next(t); !slices.Equal(got, []string{": heartbeat"}) {
+		t.Fatalf("idle stream sent %q, want a heartbeat", got)
+	}
+
+	for _, name := range []string{"Ada", "Grace"} {
+		resp, err := srv.Client().Post(srv.URL+"/v2/people", "application/json", strings.NewReader(`{"name":"`+name+`","age":36}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	first, second := stream.nextEvent(t), stream.nextEvent(t)
+	firstID, _ := strconv.ParseUint(first["id"], 10, 64)
+	secondID, _ := strconv.ParseUint(second["id"], 10, 64)
+	if first["event"] != eventCreated || secondID <= firstID {
+		t.Fatalf("events %v then %v, want created events with increasing IDs", first, second)
+	}
+
+	tests := []struct {
+		name, lastID string
+		wantEvent    string
+		wantID       string
+	}{
+		{"resume after the first", first["id"], eventCreated, second["id"]},
+		{"unknown ID", "1", "reset", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := openSSE(t, srv, "/v2/people/events", tt.lastID).nextEvent(t)
+			if ev["event"] != tt.wantEvent || ev["id"] != tt.wantID {
+				t.Fatalf("first event after Last-Event-ID %s = %v, want %s %s", tt.lastID, ev, tt.wantEvent, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestProjectedEventsStream(t *testing.T) {
+	srv := httptest.NewServer(newTestServer(t, testConfig(t)).handler())
+	// Registered first so it runs last, once the streams are closed.
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		query      string
+		wantPerson string // with the ID of the created person as %d
+	}{
+		{"?fields=name", `{"name":"Ada Lovelace"}`},
+		{"?fields=id,name&include=initials", `{"id":%d,"name":"Ada Lovelace","initials":"AL"}`},
+		{"?fields=age&include=age_group", `{"age":36,"age_group":"adult"}`},
+		{"?fields=phone", `{}`},
+	}
+	streams := make([]*sseStream, len(tests))
+	for i, tt := range tests {
+		streams[i] = openSSE(t, srv, "/v2/people/events"+tt.query, "")
+	}
+	full := openSSE(t, srv, "/v2/people/events", "")
+
+	resp, err := srv.Client().Post(srv.URL+"/v2/people", "application/json", strings.NewReader(`{"name":"Ada Lovelace","age":36,"email":"ada@example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id, _ := strconv.Atoi(filepath.Base(resp.Header.Get("Location")))
+
+	var want map[string]json.RawMessage
+	err = json.Unmarshal([]byte(full.nextEvent(t)["data"]), &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var got map[string]json.RawMessage
+			err := json.Unmarshal([]byte(streams[i].nextEvent(t)["data"]), &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The envelope is never projected, only the person in it.
+			for _, key := range []string{"id", "type", "time", "version", "actor"} {
+				if !bytes.Equal(got[key], want[key]) {
+					t.Errorf("%s = %s, want %s", key, got[key], want[key])
+				}
+			}
+			wantPerson := tt.wantPerson
+			if strings.Contains(wantPerson, "%d") {
+				wantPerson = fmt.Sprintf(wantPerson, id)
+			}
+			if string(got["person"]) != wantPerson {
+				t.Errorf("person = %s, want %s", got["person"], wantPerson)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration
+// histogram. They match the Prometheus client defaults.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// routeKey labels the latency histogram.
+type routeKey struct {
+	route  string
+	method string
+}
+
+// requestKey labels the request counter.
+type requestKey struct {
+	routeKey
+	code int
+}
+
+// histogram counts observations per bucket. counts[i] holds observations in
+// (latencyBuckets[i-1], latencyBuckets[i]]; the last entry is the +Inf bucket.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// httpMetrics collects request metrics for /metrics.
+type httpMetrics struct {
+	mu        sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+	inFlight  atomic.Int64
+	start     time.Time
+}
+
+// newHTTPMetrics returns an empty collector.
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[routeKey]*histogram),
+		start:     time.Now(),
+	}
+}
+
+// observe records one finished request.
+func (m *httpMetrics) observe(route, method string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rk := routeKey{route: route, method: method}
+	m.requests[requestKey{routeKey: rk, code: code}]++
+
+	h, ok := m.durations[rk]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.durations[rk] = h
+	}
+	sec := d.Seconds()
+	i, _ := slices.BinarySearch(latencyBuckets, sec)
+	h.counts[i]++
+	h.sum += sec
+	h.count++
+}
+
+// metricsMethod keeps the method label bounded: any method the API does not
+// use is reported as "other", so clients cannot create unlimited series.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// withMetrics counts requests by route pattern, method and status and times
+// them. The route is the pattern mux would pick, such as "/people/{id}",
+// rather than the raw path, so IDs do not become labels.
+func (s *server) withMetrics(mux *http.ServeMux) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw, ok := w.(*statusWriter)
+			if !ok {
+				sw = &statusWriter{ResponseWriter: w}
+			}
+			_, route := mux.Handler(r)
+
+			s.metrics.inFlight.Add(1)
+			start := time.Now()
+			defer func() {
+				s.metrics.inFlight.Add(-1)
+				s.metrics.observe(route, metricsMethod(r.Method), sw.statusCode(), time.Since(start))
+			}()
+
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// metricsHandler serves every metric in the Prometheus text exposition
+// format, version 0.0.4.
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, r, "GET, HEAD")
+		return
+	}
+
+	people, err := s.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	s.metrics.writeTo(bw)
+	writeGauge(bw, "people_total", "Number of people in the store.", float64(len(people)))
+	writeRuntimeMetrics(bw)
+
+	err = bw.Flush()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing metrics", "err", err)
+	}
+}
+
+// writeTo writes the request metrics, sorted so the output is stable.
+func (m *httpMetrics) writeTo(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "http_requests_total", "counter", "HTTP requests by route pattern, method and status code.")
+	reqKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		reqKeys = append(reqKeys, k)
+	}
+	slices.SortFunc(reqKeys, func(a, b requestKey) int {
+		return cmp.Or(compareRouteKeys(a.routeKey, b.routeKey), cmp.Compare(a.code, b.code))
+	})
+	for _, k := range reqKeys {
+		fmt.Fprintf(w, "http_requests_total{route=%s,method=%s,code=\"%d\"} %d\n",
+			labelValue(k.route), labelValue(k.method), k.code, m.requests[k])
+	}
+
+	writeHeader(w, "http_request_duration_seconds", "histogram", "HTTP request latency by route pattern and method.")
+	routeKeys := make([]routeKey, 0, len(m.durations))
+	for k := range m.durations {
+		routeKeys = append(routeKeys, k)
+	}
+	slices.SortFunc(routeKeys, compareRouteKeys)
+	for _, k := range routeKeys {
+		h := m.durations[k]
+		labels := "route=" + labelValue(k.route) + ",method=" + labelValue(k.method)
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	writeGauge(w, "http_requests_in_flight", "HTTP requests currently being served.", float64(m.inFlight.Load()))
+	writeGauge(w, "process_start_time_seconds", "Start time of the process since the Unix epoch in seconds.", float64(m.start.Unix()))
+}
+
+func compareRouteKeys(a, b routeKey) int {
+	return cmp.Or(cmp.Compare(a.route, b.route), cmp.Compare(a.method, b.method))
+}
+
+// writeRuntimeMetrics writes goroutine, heap and GC statistics.
+func writeRuntimeMetrics(w *bufio.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	writeGauge(w, "go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	writeGauge(w, "go_memstats_heap_alloc_bytes", "Heap bytes allocated and still in use.", float64(ms.HeapAlloc))
+	writeGauge(w, "go_memstats_heap_inuse_bytes", "Heap bytes in in-use spans.", float64(ms.HeapInuse))
+	writeGauge(w, "go_memstats_heap_objects", "Number of allocated heap objects.", float64(ms.HeapObjects))
+	writeGauge(w, "go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", float64(ms.Sys))
+	writeCounter(w, "go_gc_cycles_total", "Completed GC cycles.", float64(ms.NumGC))
+	writeCounter(w, "go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", float64(ms.PauseTotalNs)/1e9)
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeGauge(w *bufio.Writer, name, help string, v float64) {
+	writeHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+func writeCounter(w *bufio.Writer, name, help string, v float64) {
+	writeHeader(w, name, "counter", help)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+}
+
+// labelEscaper escapes a label value as the exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns v escaped and quoted.
+func labelValue(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// formatFloat writes v in the shortest form Prometheus parses back exactly,
+// without an exponent for whole numbers such as byte counts.
+func formatFloat(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
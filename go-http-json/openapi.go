@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// openAPIVersion is the version of the API described by /openapi.json.
+const openAPIVersion = "1.0.0"
+
+// router registers handlers on a ServeMux and keeps a description of every
+// operation, from which the OpenAPI document is generated. Registering a
+// route and documenting it is one call, so the two cannot drift apart.
+type router struct {
+	mux    *http.ServeMux
+	routes []route
+}
+
+// route is one registered pattern and the operations it serves.
+type route struct {
+	pattern string
+	ops     []operation
+}
+
+// operation documents one method on a route. request and the bodies in
+// responses are zero values of the Go types that are read and written; their
+// schemas are derived from the json and validate struct tags.
+type operation struct {
+	method     string
+	id         string
+	summary    string
+	params     []param
+	request    any
+	reqTypes   []string // request media types; default application/json
+	responses  []apiResponse
+	problems   []int
+	public     bool
+	deprecated bool
+}
+
+// param documents a query or header parameter.
+type param struct {
+	in          string // "query" or "header"
+	name        string
+	typ         string // JSON Schema type
+	description string
+}
+
+// apiResponse documents a non-problem response. With no mediaTypes the body
+// is application/json; a nil body means the response has none.
+type apiResponse struct {
+	status     int
+	body       any
+	mediaTypes []string
+}
+
+// Media types used in the document.
+const (
+	mediaJSON        = "application/json"
+	mediaProblem     = "application/problem+json"
+	mediaEventStream = "text/event-stream"
+)
+
+// newRouter returns an empty router.
+func newRouter() *router {
+	return &router{mux: http.NewServeMux()}
+}
+
+// handle registers h for pattern and records its operations. Undocumented
+// routes, such as the catch-all "/", pass no operations.
+func (rt *router) handle(pattern string, h http.HandlerFunc, ops ...operation) {
+	rt.mux.HandleFunc(pattern, h)
+	if len(ops) > 0 {
+		rt.routes = append(rt.routes, route{pattern: pattern, ops: ops})
+	}
+}
+
+// verboseParam is the ?verbose flag of the health probes.
+var verboseParam = param{in: "query", name: "verbose", typ: "boolean", description: "Include the result of every check."}
+
+// listParams are the query parameters of GET /people.
+var listParams = []param{
+	{in: "query", name: "limit", typ: "integer", description: "Page size, 1 to 500; default 50."},
+	{in: "query", name: "cursor", typ: "string", description: "Opaque cursor from the previous page's next link."},
+	{in: "query", name: "min_age", typ: "integer", description: "Only people at least this old."},
+	{in: "query", name: "max_age", typ: "integer", description: "Only people at most this old."},
+	{in: "query", name: "name_prefix", typ: "string", description: "Case-insensitive name prefix."},
+	{in: "query", name: "sort", typ: "string", description: "Comma-separated fields (id, name, age); prefix with - for descending."},
+	{in: "query", name: "format", typ: "string", description: "json, ndjson or csv; overrides Accept."},
+	{in: "query", name: "include_deleted", typ: "boolean", description: "Also list soft-deleted people, marked by deleted_at."},
+	asOfParam,
+	fieldsParam,
+	includeParam,
+}
+
+// fieldsParam and includeParam shape the people in a response; see
+// parseProjection.
+var (
+	fieldsParam  = param{in: "query", name: "fields", typ: "string", description: "Comma-separated fields to keep, such as id,name; default all."}
+	includeParam = param{in: "query", name: "include", typ: "string", description: "Comma-separated computed fields to add: age_group, initials."}
+)
+
+// asOfParam turns a read into a point-in-time read from the revision history.
+var asOfParam = param{in: "query", name: "as_of", typ: "string", description: "RFC 3339 timestamp; return the state at that moment."}
+
+// pathParamPattern finds {name} segments in a route pattern.
+var pathParamPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// openAPI builds the OpenAPI 3.1 document for the registered routes.
+func (rt *router) openAPI() map[string]any {
+	g := &schemaGen{components: map[string]any{}}
+
+	// Every problem response shares one schema, registered up front.
+	problemRef := g.schema(reflect.TypeOf(problem{}))
+
+	paths := map[string]any{}
+	for _, rte := range rt.routes {
+		item := map[string]any{}
+		for _, op := range rte.ops {
+			item[strings.ToLower(op.method)] = g.operation(rte.pattern, op, problemRef)
+		}
+		paths[rte.pattern] = item
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":       "People API",
+			"version":     openAPIVersion,
+			"description": "CRUD API for people, generated from the go-http-json route table.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An API key or a JWT with people:read / people:write scopes.",
+				},
+			},
+		},
+	}
+}
+
+// schemaGen turns Go types into JSON Schemas, collecting named struct types
+// under components/schemas. While projecting, people are described as they
+// look after ?fields= and ?include=, under a "Projection" component name.
+type schemaGen struct {
+	components map[string]any
+	projecting bool
+}
+
+// projected documents a response body of type T whose people are shaped by
+// ?fields= and ?include=. Its schema is that of T with every person
+// replaced by a projection: the same properties, none of them required,
+// plus the computed fields.
+type projected[T any] struct{}
+
+func (projected[T]) projectedType() reflect.Type { return reflect.TypeFor[T]() }
+
+// projectable is implemented by every projected type.
+var projectable = reflect.TypeFor[interface{ projectedType() reflect.Type }]()
+
+// personTypes are the representations of a person that can be projected.
+var personTypes = []reflect.Type{reflect.TypeFor[Person](), reflect.TypeFor[personV1]()}
+
+// operation builds one OpenAPI operation object.
+func (g *schemaGen) operation(pattern string, op operation, problemRef map[string]any) map[string]any {
+	out := map[string]any{
+		"operationId": op.id,
+		"summary":     op.summary,
+	}
+	if op.deprecated {
+		out["deprecated"] = true
+	}
+
+	var params []any
+	// Person IDs are positive integers; admin IDs are opaque strings.
+	idSchema := map[string]any{"type": "integer", "minimum": 1}
+	if isAdminPath(pattern) {
+		idSchema = map[string]any{"type": "string"}
+	}
+	for _, m := range pathParamPattern.FindAllStringSubmatch(pattern, -1) {
+		params = append(params, map[string]any{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   idSchema,
+		})
+	}
+	for _, p := range op.params {
+		params = append(params, map[string]any{
+			"name":        p.name,
+			"in":          p.in,
+			"description": p.description,
+			"schema":      map[string]any{"type": p.typ},
+		})
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+
+	if op.request != nil {
+		out["requestBody"] = map[string]any{
+			"required": true,
+			"content":  g.content(op.request, op.reqTypes),
+		}
+	}
+
+	responses := map[string]any{}
+	for _, res := range op.responses {
+		obj := map[string]any{"description": http.StatusText(res.status)}
+		if res.body != nil {
+			obj["content"] = g.content(res.body, res.mediaTypes)
+		}
+		responses[strconv.Itoa(res.status)] = obj
+	}
+
+	problems := slices.Clone(op.problems)
+	if !op.public {
+		problems = append(problems, http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests)
+		out["security"] = []any{map[string]any{"bearerAuth": []string{}}}
+	}
+	problems = append(problems, http.StatusInternalServerError)
+	for _, status := range problems {
+		responses[strconv.Itoa(status)] = map[string]any{
+			"description": http.StatusText(status),
+			"content": map[string]any{
+				mediaProblem: map[string]any{"schema": problemRef},
+			},
+		}
+	}
+	out["responses"] = responses
+	return out
+}
+
+// content builds a content map for body in each media type. JSON gets the
+// schema of body. An event stream is a string whose events each carry body
+// as JSON in their data, which contentSchema describes. Other formats are
+// documented as plain strings.
+func (g *schemaGen) content(body any, mediaTypes []string) map[string]any {
+	if len(mediaTypes) == 0 {
+		mediaTypes = []string{mediaJSON}
+	}
+	content := map[string]any{}
+	for _, mt := range mediaTypes {
+		schema := map[string]any{"type": "string"}
+		switch mt {
+		case mediaJSON:
+			schema = g.schema(reflect.TypeOf(body))
+		case mediaEventStream:
+			schema["description"] = "Server-Sent Events. The data of each event is one JSON object matching contentSchema."
+			schema["contentMediaType"] = mediaJSON
+			schema["contentSchema"] = g.schema(reflect.TypeOf(body))
+		}
+		content[mt] = map[string]any{"schema": schema}
+	}
+	return content
+}
+
+// timeType is documented as an RFC 3339 string rather than a struct.
+var timeType = reflect.TypeOf(time.Time{})
+
+// rawMessageType holds any JSON value, so it has an empty schema.
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// schema returns the JSON Schema for t. Named struct types are added to the
+// components once and referenced with $ref.
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Implements(projectable):
+		pg := &schemaGen{components: g.components, projecting: true}
+		return pg.schema(reflect.Zero(t).Interface().(interface{ projectedType() reflect.Type }).projectedType())
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		name := componentName(t)
+		build := g.structSchema
+		if g.projecting {
+			name += "Projection"
+			if slices.Contains(personTypes, t) {
+				build = g.projectionSchema
+			}
+		}
+		if _, ok := g.components[name]; !ok {
+			// Reserve the name first so recursive types terminate.
+			g.components[name] = nil
+			g.components[name] = build(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return g.structSchema(t)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	}
+	return map[string]any{}
+}
+
+// nullable extends schema to also accept null.
+func nullable(schema map[string]any) map[string]any {
+	if t, ok := schema["type"].(string); ok {
+		schema["type"] = []string{t, "null"}
+		return schema
+	}
+	return map[string]any{"anyOf": []any{schema, map[string]any{"type": "null"}}}
+}
+
+// componentName exports a Go type name, so createPersonRequest becomes
+// CreatePersonRequest.
+func componentName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// structSchema describes the JSON object encoding/json produces for t,
+// including fields promoted from embedded structs.
+func (g *schemaGen) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	g.addFields(t, props, &required)
+
+	out := map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		slices.Sort(required)
+		out["required"] = required
+	}
+	return out
+}
+
+// projectionSchema describes person type t after ?fields= and ?include=:
+// any of its properties may be missing, and computed fields may follow.
+// The properties themselves are not projected, so an address stays whole.
+func (g *schemaGen) projectionSchema(t reflect.Type) map[string]any {
+	schema := (&schemaGen{components: g.components}).structSchema(t)
+	delete(schema, "required")
+	props := schema["properties"].(map[string]any)
+	for _, c := range computedFields {
+		props[c.name] = c.schema
+	}
+	return schema
+}
+
+func (g *schemaGen) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.addFields(f.Type, props, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		schema := g.schema(f.Type)
+		if f.Type.Kind() == reflect.Pointer {
+			// encoding/json reads null into a pointer as "not set".
+			schema = nullable(schema)
+		}
+		if applyConstraints(schema, f.Tag.Get("validate")) {
+			*required = append(*required, name)
+		}
+		if doc := f.Tag.Get("doc"); doc != "" {
+			schema["description"] = doc
+		}
+		props[name] = schema
+	}
+}
+
+// applyConstraints copies the rules of a validate tag, such as
+// "required,minlen=1,maxlen=100", into schema and reports whether the field
+// is required. Supported rules: required, readonly, min, max, minlen, maxlen,
+// maxitems, enum (values separated by |) and pattern (a name from
+// namedPatterns). On an array, minlen, maxlen and pattern apply to each item.
+// An optional string may also be empty, which clears it, so its pattern
+// accepts "" too.
+func applyConstraints(schema map[string]any, tag string) (required bool) {
+	if tag == "" {
+		return false
+	}
+	target := schema
+	items, isArray := schema["items"].(map[string]any)
+	if isArray {
+		target = items
+	}
+	var pattern string
+	for _, rule := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+			required = true
+		case "readonly":
+			schema["readOnly"] = true
+		case "min", "max", "maxitems":
+			schema[map[string]string{"min": "minimum", "max": "maximum", "maxitems": "maxItems"}[key]] = tagInt(tag, key, value)
+		case "minlen", "maxlen":
+			target[map[string]string{"minlen": "minLength", "maxlen": "maxLength"}[key]] = tagInt(tag, key, value)
+		case "enum":
+			schema["enum"] = strings.Split(value, "|")
+		case "pattern":
+			re, ok := namedPatterns[value]
+			if !ok {
+				panic(fmt.Sprintf("validate tag %q: unknown pattern %q", tag, value))
+			}
+			pattern = re.String()
+		default:
+			panic(fmt.Sprintf("validate tag %q: unknown rule %q", tag, key))
+		}
+	}
+	if pattern != "" {
+		if !required && !isArray {
+			pattern = "^$|" + pattern
+		}
+		target["pattern"] = pattern
+	}
+	return required
+}
+
+// tagInt parses the integer value of a validate rule.
+func tagInt(tag, key, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Sprintf("validate tag %q: %s needs an integer", tag, key))
+	}
+	return n
+}
+
+// openAPIHandler serves the document generated from rt.
+func openAPIHandler(rt *router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, r, "GET, HEAD")
+			return
+		}
+
+		w.Header().Set("Content-Type", mediaJSON)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(rt.openAPI())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error encoding OpenAPI document", "err", err)
+		}
+	}
+}
+
+// dumpOpenAPI writes the document to path, or to stdout if path is "-".
+func dumpOpenAPI(cfg config, path string) error {
+	cfg.DataDir = ""
+	webhooks, err := openWebhookDispatcher(cfg)
+	if err != nil {
+		return err
+	}
+	history, err := openHistoryLog("")
+	if err != nil {
+		return err
+	}
+	s := newServer(cfg, newMemoryStore(), webhooks, history)
+	data, err := json.MarshalIndent(s.routes().openAPI(), "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Machine-readable error codes returned in the "code" member of a problem.
+const (
+	codeNotFound              = "not_found"
+	codeMethodNotAllowed      = "method_not_allowed"
+	codeInvalidJSON           = "invalid_json"
+	codeUnknownField          = "unknown_field"
+	codeBodyTooLarge          = "body_too_large"
+	codeUnsupportedMediaType  = "unsupported_media_type"
+	codeNotAcceptable         = "not_acceptable"
+	codeInvalidQuery          = "invalid_query"
+	codeValidation            = "validation_failed"
+	codeIDMismatch            = "id_mismatch"
+	codePreconditionFailed    = "precondition_failed"
+	codeInvalidIdempotencyKey = "invalid_idempotency_key"
+	codeIdempotencyKeyReused  = "idempotency_key_reused"
+	codeIdempotencyInProgress = "idempotency_in_progress"
+	codeUnauthorized          = "unauthorized"
+	codeForbidden             = "forbidden"
+	codeRateLimited           = "rate_limited"
+	codeNotDeleted            = "not_deleted"
+	codeInternal              = "internal_error"
+)
+
+// problem is an RFC 7807 problem details document with extension members
+// for a stable error code, per-field validation errors and the request ID.
+type problem struct {
+	Type     string       `json:"type" validate:"required"`
+	Title    string       `json:"title" validate:"required"`
+	Status   int          `json:"status" validate:"required"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code" validate:"required"`
+	Errors   []fieldError `json:"errors,omitempty"`
+
+	// RequestID matches the X-Request-ID header, for quoting in bug reports.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// fieldError describes one invalid field of a request body.
+type fieldError struct {
+	Field   string `json:"field" validate:"required"`
+	Code    string `json:"code" validate:"required"`
+	Message string `json:"message" validate:"required"`
+}
+
+// newProblem fills in the members shared by every problem. The type is a
+// relative URI derived from the code, and the instance is the request URI.
+func newProblem(r *http.Request, status int, code, detail string) problem {
+	return problem{
+		Type:     "/problems/" + code,
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.RequestURI(),
+		Code:     code,
+
+		RequestID: requestIDFrom(r.Context()),
+	}
+}
+
+// writeProblem is the single error-writing path for all handlers.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	sendProblem(w, newProblem(r, status, code, detail))
+}
+
+// writeValidationProblem reports every invalid field at once with a 400.
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	p := newProblem(r, http.StatusBadRequest, codeValidation, "one or more fields are invalid")
+	p.Errors = errs
+	sendProblem(w, p)
+}
+
+// writeMethodNotAllowed sets the Allow header and writes a 405 problem.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method "+r.Method+" is not allowed; use "+allow)
+}
+
+// sendProblem encodes p as application/problem+json.
+func sendProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+
+	err := json.NewEncoder(w).Encode(p)
+	if err != nil {
+		slog.Error("error encoding problem response", "err", err)
+	}
+}
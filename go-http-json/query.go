@@ -0,0 +1,241 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Page size limits for GET /people.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// sortableFields lists the Person fields accepted by ?sort=.
+var sortableFields = []string{"id", "name", "age"}
+
+// sortKey is one entry of a ?sort= list, such as "-name".
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// listCursor is the decoded form of the opaque ?cursor= value. It holds the
+// sort spec and the sort values of the last person on the previous page, so
+// the next page starts strictly after it even if people were added or removed
+// in between.
+type listCursor struct {
+	Sort string `json:"s"`
+	ID   int    `json:"i"`
+	Name string `json:"n,omitempty"`
+	Age  int    `json:"a,omitempty"`
+}
+
+// listQuery is the parsed form of the GET /people query string.
+type listQuery struct {
+	limit      int
+	limitSet   bool
+	cursor     *listCursor
+	minAge     *int
+	maxAge     *int
+	namePrefix string
+	sortSpec   string
+	sort       []sortKey
+
+	includeDeleted bool
+}
+
+// parseListQuery validates the pagination, filter and sort parameters.
+func parseListQuery(v url.Values) (listQuery, error) {
+	q := listQuery{limit: defaultPageLimit}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return q, fmt.Errorf("limit must be an integer between 1 and %d", maxPageLimit)
+		}
+		q.limit = n
+		q.limitSet = true
+	}
+
+	for _, name := range []string{"min_age", "max_age"} {
+		s := v.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("%s must be a non-negative integer", name)
+		}
+		if name == "min_age" {
+			q.minAge = &n
+		} else {
+			q.maxAge = &n
+		}
+	}
+	q.namePrefix = v.Get("name_prefix")
+
+	if s := v.Get("include_deleted"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, errors.New("include_deleted must be true or false")
+		}
+		q.includeDeleted = b
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		c, err := decodeCursor(s)
+		if err != nil {
+			return q, err
+		}
+		q.cursor = &c
+	}
+
+	q.sortSpec = v.Get("sort")
+	if q.sortSpec == "" && q.cursor != nil {
+		q.sortSpec = q.cursor.Sort
+	}
+	if q.cursor != nil && q.cursor.Sort != q.sortSpec {
+		return q, errors.New("cursor was issued for a different sort order")
+	}
+
+	keys, err := parseSort(q.sortSpec)
+	if err != nil {
+		return q, err
+	}
+	q.sort = keys
+
+	return q, nil
+}
+
+// parseSort parses a comma-separated list such as "age,-name". The result
+// always ends with the ID so the ordering is total and cursors are stable.
+func parseSort(spec string) ([]sortKey, error) {
+	var keys []sortKey
+	hasID := false
+
+	if spec != "" {
+		for _, part := range strings.Split(spec, ",") {
+			key := sortKey{field: strings.TrimSpace(part)}
+			if strings.HasPrefix(key.field, "-") {
+				key.desc = true
+				key.field = key.field[1:]
+			}
+			if !slices.Contains(sortableFields, key.field) {
+				return nil, fmt.Errorf("cannot sort by %q; use one of %s", key.field, strings.Join(sortableFields, ", "))
+			}
+			if key.field == "id" {
+				hasID = true
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if !hasID {
+		keys = append(keys, sortKey{field: "id"})
+	}
+	return keys, nil
+}
+
+// compare orders two people according to the sort keys.
+func (q listQuery) compare(a, b Person) int {
+	for _, k := range q.sort {
+		var c int
+		switch k.field {
+		case "id":
+			c = cmp.Compare(a.ID, b.ID)
+		case "name":
+			c = cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+			if c == 0 {
+				c = cmp.Compare(a.Name, b.Name)
+			}
+		case "age":
+			c = cmp.Compare(a.Age, b.Age)
+		}
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// match reports whether p passes the filters.
+func (q listQuery) match(p Person) bool {
+	if q.minAge != nil && p.Age < *q.minAge {
+		return false
+	}
+	if q.maxAge != nil && p.Age > *q.maxAge {
+		return false
+	}
+	if q.namePrefix != "" && !strings.HasPrefix(strings.ToLower(p.Name), strings.ToLower(q.namePrefix)) {
+		return false
+	}
+	return true
+}
+
+// page filters and sorts all, then returns the people after the cursor up to
+// the limit. next is non-nil when more people follow.
+func (q listQuery) page(all []Person) (page []Person, next *listCursor) {
+	matched := make([]Person, 0, len(all))
+	for _, p := range all {
+		if q.match(p) {
+			matched = append(matched, p)
+		}
+	}
+	slices.SortFunc(matched, q.compare)
+
+	if q.cursor != nil {
+		after := Person{ID: q.cursor.ID, Name: q.cursor.Name, Age: q.cursor.Age}
+		start, _ := slices.BinarySearchFunc(matched, after, q.compare)
+		// Skip the cursor person itself if it still exists.
+		if start < len(matched) && q.compare(matched[start], after) == 0 {
+			start++
+		}
+		matched = matched[start:]
+	}
+
+	if len(matched) <= q.limit {
+		return matched, nil
+	}
+
+	page = matched[:q.limit]
+	last := page[len(page)-1]
+	return page, &listCursor{Sort: q.sortSpec, ID: last.ID, Name: last.Name, Age: last.Age}
+}
+
+// encodeCursor turns a cursor into an opaque URL-safe token.
+func encodeCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reverses encodeCursor.
+func decodeCursor(s string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, errors.New("cursor is malformed")
+	}
+	return c, nil
+}
+
+// nextPageURL builds the link to the page after next, keeping the caller's
+// filters, sort and limit.
+func nextPageURL(u *url.URL, next listCursor) string {
+	v := u.Query()
+	v.Set("cursor", encodeCursor(next))
+	return u.Path + "?" + v.Encode()
+}
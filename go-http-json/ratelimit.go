@@ -0,0 +1,234 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle buckets are looked for.
+const rateLimitSweepInterval = time.Minute
+
+// unlimitedPaths are never rate limited, so health checks keep working
+// while a client is being throttled.
+var unlimitedPaths = map[string]bool{
+	"/status":       true,
+	"/metrics":      true,
+	"/livez":        true,
+	"/readyz":       true,
+	"/openapi.json": true,
+}
+
+// tokenBucket holds the tokens left for one client at the time of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a set of token buckets keyed by client. Each bucket holds
+// up to burst tokens and refills at rate tokens per second.
+//
+// A bucket that has had time to refill completely behaves exactly like a
+// missing one, so sweep deletes those. Memory is therefore bounded by the
+// number of clients active within one refill period (burst/rate seconds).
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a limiter, or nil when rate is not positive, which
+// disables limiting.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(max(burst, 1)),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// rateLimitResult describes the bucket after a call to allow.
+type rateLimitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	retryAfter time.Duration // until one token is available; zero when allowed
+	reset      time.Duration // until the bucket is full again
+}
+
+// allow takes one token from key's bucket if there is one.
+func (l *rateLimiter) allow(key string, now time.Time) rateLimitResult {
+	return l.check(key, now, true)
+}
+
+// peek reports whether key's bucket has a token, without taking it.
+func (l *rateLimiter) peek(key string, now time.Time) rateLimitResult {
+	return l.check(key, now, false)
+}
+
+// check refills key's bucket and, if take is set, takes one token.
+func (l *rateLimiter) check(key string, now time.Time, take bool) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	res := rateLimitResult{limit: int(l.burst)}
+	if b.tokens >= 1 {
+		if take {
+			b.tokens--
+		}
+		res.allowed = true
+	} else {
+		res.retryAfter = l.secondsFor(1 - b.tokens)
+	}
+	res.remaining = int(b.tokens)
+	res.reset = l.secondsFor(l.burst - b.tokens)
+	return res
+}
+
+// secondsFor returns how long it takes to refill n tokens.
+func (l *rateLimiter) secondsFor(n float64) time.Duration {
+	return time.Duration(n / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that would be full by now. The caller must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	refill := l.secondsFor(l.burst)
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// withRateLimit applies the read budget to GET, HEAD and OPTIONS requests
+// and the write budget to everything else. Rejected requests get 429 with
+// Retry-After; every limited response carries RateLimit-* headers.
+func (s *server) withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := s.limiterFor(r)
+		if limiter == nil || unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res := limiter.allow(s.rateLimitKey(r), time.Now())
+		setRateLimitHeaders(w, res)
+		if !res.allowed {
+			writeRateLimited(w, r, res)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withAuthFailureLimit runs before withAuth and limits failed logins per
+// client IP, so credentials cannot be guessed at full speed. Only a request
+// answered with 401 takes a token from the IP's bucket, so callers with
+// valid credentials never use it up; once it is empty, every request from
+// that IP gets 429 before its credentials are looked at. It shares the read
+// and write limiters with withRateLimit, under "ip:" keys that withRateLimit
+// does not use while auth is on.
+func (s *server) withAuthFailureLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := s.limiterFor(r)
+		if limiter == nil || !s.authEnabled() || unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := "ip:" + clientIP(r, s.cfg.TrustProxy)
+		if res := limiter.peek(key, time.Now()); !res.allowed {
+			setRateLimitHeaders(w, res)
+			writeRateLimited(w, r, res)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.statusCode() == http.StatusUnauthorized {
+			limiter.allow(key, time.Now())
+		}
+	})
+}
+
+// limiterFor returns the read or write limiter for r, or nil when that
+// budget is disabled.
+func (s *server) limiterFor(r *http.Request) *rateLimiter {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return s.readLimiter
+	}
+	return s.writeLimiter
+}
+
+// setRateLimitHeaders describes the client's bucket in RateLimit-* headers.
+func setRateLimitHeaders(w http.ResponseWriter, res rateLimitResult) {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(res.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+	h.Set("RateLimit-Reset", ceilSeconds(res.reset))
+}
+
+// writeRateLimited answers 429 with Retry-After.
+func writeRateLimited(w http.ResponseWriter, r *http.Request, res rateLimitResult) {
+	w.Header().Set("Retry-After", ceilSeconds(res.retryAfter))
+	writeProblem(w, r, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded; retry after "+ceilSeconds(res.retryAfter)+"s")
+}
+
+// rateLimitKey identifies the client: the API key set by withAuth, so each
+// key has its own budget, otherwise the client IP.
+func (s *server) rateLimitKey(r *http.Request) string {
+	if p, ok := principalFrom(r.Context()); ok {
+		return "key:" + p.ID
+	}
+	return "ip:" + clientIP(r, s.cfg.TrustProxy)
+}
+
+// clientIP returns the remote IP, or the last X-Forwarded-For entry when
+// the server runs behind a trusted proxy. Proxies append the address they
+// saw to the right, so only the last entry comes from our proxy; anything
+// left of it was sent by the client and can be forged.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+			entries := strings.Split(xff[len(xff)-1], ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+				return last
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ceilSeconds formats d as whole seconds, rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
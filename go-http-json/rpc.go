@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// maxRPCBatch caps the number of calls in one JSON-RPC batch.
+const maxRPCBatch = 100
+
+// JSON-RPC 2.0 error codes. The first five are defined by the spec; the
+// others are from its range for implementation-defined server errors.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcForbidden      = -32003
+	rpcNotFound       = -32004
+)
+
+// rpcRequest is one JSON-RPC call. A call without an id is a notification
+// and gets no response. Params, when sent, must be an object.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc" validate:"required,enum=2.0"`
+	Method  string          `json:"method" validate:"required,enum=people.list|people.get|people.create|people.update|people.delete|people.stats"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// rpcResponse answers one call. Exactly one of Result and Error is set;
+// Result is kept as raw JSON so that a null result is still sent.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc" validate:"required"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id" validate:"required"`
+}
+
+// rpcError is the error member of a response. Data carries the same
+// machine-readable code and field errors as the REST problem responses.
+type rpcError struct {
+	Code    int           `json:"code" validate:"required"`
+	Message string        `json:"message" validate:"required"`
+	Data    *rpcErrorData `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcErrorData is the data member of an rpcError.
+type rpcErrorData struct {
+	Code      string       `json:"code" validate:"required"`
+	Detail    string       `json:"detail,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// rpcMethod is a callable method and the scope a caller needs for it.
+type rpcMethod struct {
+	scope string
+	call  func(s *server, ctx context.Context, params json.RawMessage) (any, error)
+}
+
+// rpcMethods are the person operations exposed over JSON-RPC. They share
+// the store and validation of the REST handlers and use the v2 shapes.
+var rpcMethods = map[string]rpcMethod{
+	"people.list":   {scopeRead, (*server).rpcListPeople},
+	"people.get":    {scopeRead, (*server).rpcGetPerson},
+	"people.stats":  {scopeRead, (*server).rpcPeopleStats},
+	"people.create": {scopeWrite, (*server).rpcCreatePerson},
+	"people.update": {scopeWrite, (*server).rpcUpdatePerson},
+	"people.delete": {scopeWrite, (*server).rpcDeletePerson},
+}
+
+// rpcHandler serves JSON-RPC 2.0 over HTTP POST. The body is a single call
+// or a batch of up to maxRPCBatch calls, which are run in order. Responses
+// use 200 even when calls fail; a body of only notifications gets 204.
+// Errors before the JSON is parsed, such as a wrong Content-Type or an
+// oversized body, are problem responses as everywhere else.
+func (s *server) rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	err := checkJSONContentType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeRequestError(w, r, jsonDecodeError(err))
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		writeJSON(w, r, http.StatusOK, rpcFailure(r.Context(), nil, &rpcError{Code: rpcParseError, Message: "Parse error", Data: &rpcErrorData{Code: codeInvalidJSON, Detail: "request body is not valid JSON"}}))
+		return
+	}
+	if body[0] != '[' {
+		resp, ok := s.rpcCall(r.Context(), body)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, resp)
+		return
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(body, &batch)
+	if len(batch) == 0 || len(batch) > maxRPCBatch {
+		detail := fmt.Sprintf("a batch must contain 1 to %d calls", maxRPCBatch)
+		writeJSON(w, r, http.StatusOK, rpcFailure(r.Context(), nil, invalidRequest(detail)))
+		return
+	}
+	responses := []rpcResponse{}
+	for _, call := range batch {
+		if resp, ok := s.rpcCall(r.Context(), call); ok {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, responses)
+}
+
+// rpcCall runs one call of a request or batch. It returns false for a valid
+// notification, which gets no response even if it fails.
+func (s *server) rpcCall(ctx context.Context, raw json.RawMessage) (rpcResponse, bool) {
+	var req rpcRequest
+	err := decodeStrict(bytes.NewReader(raw), &req)
+	switch {
+	case err != nil:
+		return rpcFailure(ctx, nil, invalidRequest("a call must be an object with jsonrpc, method and optionally params and id")), true
+	case req.JSONRPC != "2.0":
+		return rpcFailure(ctx, nil, invalidRequest(`jsonrpc must be "2.0"`)), true
+	case !validRPCID(req.ID):
+		return rpcFailure(ctx, nil, invalidRequest("id must be a string, a number or null")), true
+	}
+
+	result, err := s.rpcInvoke(ctx, req)
+	if req.ID == nil {
+		if err != nil {
+			slog.DebugContext(ctx, "JSON-RPC notification failed", "method", req.Method, "err", err)
+		}
+		return rpcResponse{}, false
+	}
+	if err != nil {
+		return rpcFailure(ctx, req.ID, rpcErrorFrom(ctx, req.Method, err)), true
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return rpcFailure(ctx, req.ID, rpcErrorFrom(ctx, req.Method, err)), true
+	}
+	return rpcResponse{JSONRPC: "2.0", Result: data, ID: req.ID}, true
+}
+
+// rpcInvoke looks up the method, checks the caller's scope and runs it.
+// When auth is off there is no principal and every method is allowed.
+func (s *server) rpcInvoke(ctx context.Context, req rpcRequest) (any, error) {
+	m, ok := rpcMethods[req.Method]
+	if !ok {
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "Method not found", Data: &rpcErrorData{Code: codeNotFound, Detail: "no method " + req.Method}}
+	}
+	if p, ok := principalFrom(ctx); ok && s.authEnabled() && !p.has(m.scope) {
+		return nil, &rpcError{Code: rpcForbidden, Message: "Forbidden", Data: &rpcErrorData{Code: codeForbidden, Detail: fmt.Sprintf("%s requires the %s scope", req.Method, m.scope)}}
+	}
+	return m.call(s, ctx, req.Params)
+}
+
+// validRPCID reports whether id is absent, a string, a number or null.
+func validRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	var v any
+	json.Unmarshal(id, &v)
+	switch v.(type) {
+	case nil, string, float64:
+		return true
+	}
+	return false
+}
+
+// invalidRequest is the error for a call that is not a valid request object.
+func invalidRequest(detail string) *rpcError {
+	return &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request", Data: &rpcErrorData{Code: codeInvalidJSON, Detail: detail}}
+}
+
+// rpcFailure builds an error response and stamps it with the request ID.
+// The id is null when the call's own id could not be read.
+func rpcFailure(ctx context.Context, id json.RawMessage, e *rpcError) rpcResponse {
+	if e.Data != nil {
+		e.Data.RequestID = requestIDFrom(ctx)
+	}
+	return rpcResponse{JSONRPC: "2.0", Error: e, ID: id}
+}
+
+// rpcErrorFrom maps a method error to a JSON-RPC error, the way
+// writeRequestError and writeStoreError map them to problems. Unexpected
+// errors are logged and hidden from the caller.
+func rpcErrorFrom(ctx context.Context, method string, err error) *rpcError {
+	var (
+		rpcErr *rpcError
+		reqErr *requestError
+	)
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.As(err, &reqErr):
+		return &rpcError{Code: rpcInvalidParams, Message: "Invalid params", Data: &rpcErrorData{Code: reqErr.code, Detail: reqErr.detail, Errors: reqErr.fields}}
+	case errors.Is(err, errPersonNotFound):
+		return &rpcError{Code: rpcNotFound, Message: "Person not found", Data: &rpcErrorData{Code: codeNotFound}}
+	}
+	slog.ErrorContext(ctx, "JSON-RPC method failed", "method", method, "err", err)
+	return &rpcError{Code: rpcInternalError, Message: "Internal error", Data: &rpcErrorData{Code: codeInternal}}
+}
+
+// invalidParams is the error for params that decode but fail validation.
+func invalidParams(errs []fieldError) error {
+	return &requestError{code: codeValidation, detail: "one or more fields are invalid", fields: errs}
+}
+
+// decodeParams strictly decodes the params object into dst. Missing params
+// decode as an empty object.
+func decodeParams(params json.RawMessage, dst any) error {
+	if params == nil {
+		params = json.RawMessage("{}")
+	}
+	if params[0] != '{' {
+		return &requestError{code: codeInvalidJSON, detail: "params must be an object"}
+	}
+	return decodeStrict(bytes.NewReader(params), dst)
+}
+
+// checkPersonID validates the id param of the methods that take one.
+func checkPersonID(id int) error {
+	if id < 1 {
+		return invalidParams([]fieldError{{Field: "id", Code: "required", Message: "id must be a positive integer"}})
+	}
+	return nil
+}
+
+// rpcListParams are the params of people.list: the GET /v2/people query
+// parameters as typed JSON members.
+type rpcListParams struct {
+	rpcProjectionParams
+
+	Limit          *int   `json:"limit" validate:"min=1,max=500"`
+	Cursor         string `json:"cursor"`
+	MinAge         *int   `json:"min_age" validate:"min=0"`
+	MaxAge         *int   `json:"max_age" validate:"min=0"`
+	NamePrefix     string `json:"name_prefix"`
+	Sort           string `json:"sort"`
+	IncludeDeleted bool   `json:"include_deleted"`
+	AsOf           string `json:"as_of"`
+}
+
+// values converts p to the query string parseListQuery validates, so both
+// APIs accept and reject exactly the same lists.
+func (p rpcListParams) values() url.Values {
+	v := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	if p.Limit != nil {
+		v.Set("limit", strconv.Itoa(*p.Limit))
+	}
+	if p.MinAge != nil {
+		v.Set("min_age", strconv.Itoa(*p.MinAge))
+	}
+	if p.MaxAge != nil {
+		v.Set("max_age", strconv.Itoa(*p.MaxAge))
+	}
+	set("cursor", p.Cursor)
+	set("name_prefix", p.NamePrefix)
+	set("sort", p.Sort)
+	set("include_deleted", strconv.FormatBool(p.IncludeDeleted))
+	return v
+}
+
+// rpcPeoplePage is the result of people.list. NextCursor is passed back as
+// the cursor param to get the next page. Data holds people as rendered by
+// the fields and include params.
+type rpcPeoplePage struct {
+	Data       []any  `json:"data" validate:"required"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// rpcProjectionParams are the ?fields= and ?include= of people.list and
+// people.get, as arrays.
+type rpcProjectionParams struct {
+	Fields  *[]string `json:"fields"`
+	Include []string  `json:"include"`
+}
+
+// projection checks the params against the v2 representation. As with
+// ?fields=, an empty fields list is an error.
+func (p rpcProjectionParams) projection() (projection, error) {
+	var fields []string
+	if p.Fields != nil {
+		if len(*p.Fields) == 0 {
+			return projection{}, &requestError{code: codeInvalidQuery, detail: "fields must name at least one field"}
+		}
+		fields = *p.Fields
+	}
+	pr, err := newProjection(apiV2, fields, p.Include)
+	if err != nil {
+		return projection{}, &requestError{code: codeInvalidQuery, detail: err.Error()}
+	}
+	return pr, nil
+}
+
+// rpcGetParams are the params of people.get.
+type rpcGetParams struct {
+	rpcProjectionParams
+	ID   int    `json:"id" validate:"required,min=1"`
+	AsOf string `json:"as_of"`
+}
+
+// rpcDeleteParams are the params of people.delete.
+type rpcDeleteParams struct {
+	ID int `json:"id" validate:"required,min=1"`
+}
+
+// peopleStats is the result of people.stats. The age figures cover live
+// people only and are left out when there are none.
+type peopleStats struct {
+	Count   int     `json:"count" validate:"required"`
+	Deleted int     `json:"deleted" validate:"required"`
+	MinAge  int     `json:"min_age,omitempty"`
+	MaxAge  int     `json:"max_age,omitempty"`
+	MeanAge float64 `json:"mean_age,omitempty"`
+}
+
+func (s *server) rpcListPeople(ctx context.Context, params json.RawMessage) (any, error) {
+	var p rpcListParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parseListQuery(p.values())
+	if err != nil {
+		return nil, &requestError{code: codeInvalidQuery, detail: err.Error()}
+	}
+	pr, err := p.projection()
+	if err != nil {
+		return nil, err
+	}
+	asOf, pointInTime, err := parseAsOfValue(p.AsOf)
+	if err != nil {
+		return nil, &requestError{code: codeInvalidQuery, detail: err.Error()}
+	}
+
+	people, err := s.loadPeople(ctx, asOf, pointInTime, q.includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	page, next := q.page(people)
+	result := rpcPeoplePage{Data: make([]any, len(page))}
+	for i, person := range page {
+		result.Data[i] = pr.person(person)
+	}
+	if next != nil {
+		result.NextCursor = encodeCursor(*next)
+	}
+	return result, nil
+}
+
+func (s *server) rpcGetPerson(ctx context.Context, params json.RawMessage) (any, error) {
+	var p rpcGetParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPersonID(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	asOf, pointInTime, err := parseAsOfValue(p.AsOf)
+	if err != nil {
+		return nil, &requestError{code: codeInvalidQuery, detail: err.Error()}
+	}
+	pr, err := p.projection()
+	if err != nil {
+		return nil, err
+	}
+
+	var person Person
+	if pointInTime {
+		person, err = s.history.personAt(p.ID, asOf)
+	} else {
+		person, err = s.store.Get(ctx, p.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pr.person(person), nil
+}
+
+func (s *server) rpcCreatePerson(ctx context.Context, params json.RawMessage) (any, error) {
+	req := newPersonCreate(apiV2)
+	err := decodeParams(params, req)
+	if err != nil {
+		return nil, err
+	}
+	errs := req.validate()
+	if len(errs) > 0 {
+		return nil, invalidParams(errs)
+	}
+	return s.store.Create(ctx, req.person())
+}
+
+// rpcUpdatePerson changes the given fields of a person, like PATCH. The
+// params are the v2 update body with a required id.
+func (s *server) rpcUpdatePerson(ctx context.Context, params json.RawMessage) (any, error) {
+	req := &updatePersonRequestV2{}
+	err := decodeParams(params, req)
+	if err != nil {
+		return nil, err
+	}
+	if req.ID == nil {
+		return nil, checkPersonID(0)
+	}
+	err = checkPersonID(*req.ID)
+	if err != nil {
+		return nil, err
+	}
+	errs := req.validate(false)
+	if len(errs) > 0 {
+		return nil, invalidParams(errs)
+	}
+
+	return s.store.Update(ctx, *req.ID, func(p *Person) error {
+		req.apply(p, false)
+		return nil
+	})
+}
+
+// rpcDeletePerson soft-deletes a person and returns the tombstone.
+func (s *server) rpcDeletePerson(ctx context.Context, params json.RawMessage) (any, error) {
+	var p rpcDeleteParams
+	err := decodeParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	err = checkPersonID(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	return s.store.Delete(ctx, p.ID, nil)
+}
+
+func (s *server) rpcPeopleStats(ctx context.Context, params json.RawMessage) (any, error) {
+	err := decodeParams(params, &struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	people, err := s.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := s.store.ListDeleted(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := peopleStats{Count: len(people), Deleted: len(deleted)}
+	total := 0
+	for i, p := range people {
+		if i == 0 || p.Age < stats.MinAge {
+			stats.MinAge = p.Age
+		}
+		stats.MaxAge = max(stats.MaxAge, p.Age)
+		total += p.Age
+	}
+	if len(people) > 0 {
+		stats.MeanAge = float64(total) / float64(len(people))
+	}
+	return stats, nil
+}
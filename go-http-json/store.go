@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// errPersonNotFound is returned by a PersonStore when no person has the given ID.
+var errPersonNotFound = errors.New("person not found")
+
+// errNotDeleted is returned by Restore for a person that is not deleted.
+var errNotDeleted = errors.New("person is not deleted")
+
+// PersonStore is the storage contract used by every handler.
+// Implementations must be safe for concurrent use.
+//
+// Deleting a person only marks it with DeletedAt. Such tombstones are
+// invisible to List, Get, Update and Delete until they are restored or
+// purged.
+type PersonStore interface {
+	// List returns all people that are not deleted, ordered by ID.
+	List(ctx context.Context) ([]Person, error)
+	// ListDeleted returns the tombstones ordered by ID.
+	ListDeleted(ctx context.Context) ([]Person, error)
+	// Get returns the person with the given ID or errPersonNotFound.
+	Get(ctx context.Context, id int) (Person, error)
+	// Create assigns the next ID and version 1 to p, stores it and returns
+	// the stored copy.
+	Create(ctx context.Context, p Person) (Person, error)
+	// CreateMany creates all of people or none of them, assigning IDs in
+	// order, and returns the stored copies.
+	CreateMany(ctx context.Context, people []Person) ([]Person, error)
+	// Update loads the person with the given ID, passes a copy to apply and
+	// stores the result with the version incremented if apply returns nil.
+	// The load, apply and store happen atomically, so read-modify-write
+	// updates such as PATCH and If-Match checks cannot interleave.
+	Update(ctx context.Context, id int, apply func(p *Person) error) (Person, error)
+	// Delete marks the person with the given ID as deleted, increments its
+	// version and returns the tombstone, or returns errPersonNotFound. If
+	// check is not nil it runs atomically before the change, and a non-nil
+	// result aborts the delete.
+	Delete(ctx context.Context, id int, check func(p Person) error) (Person, error)
+	// Restore clears the deletion mark of a tombstone, increments its version
+	// and returns it. It returns errPersonNotFound for an unknown ID and
+	// errNotDeleted for a person that is not deleted.
+	Restore(ctx context.Context, id int) (Person, error)
+	// Purge permanently removes the tombstones deleted before cutoff and
+	// returns them.
+	Purge(ctx context.Context, cutoff time.Time) ([]Person, error)
+	// Check reports whether the store can currently accept writes. It backs
+	// the readiness probe and must be cheap.
+	Check(ctx context.Context) error
+	// Close flushes anything not yet durable. It is called once on shutdown,
+	// after the HTTP server has stopped.
+	Close() error
+}
+
+// sortPeopleByID sorts people in place by ascending ID.
+func sortPeopleByID(people []Person) {
+	slices.SortFunc(people, func(a, b Person) int { return a.ID - b.ID })
+}
+
+// memoryStore is an in-memory PersonStore guarded by a RWMutex.
+type memoryStore struct {
+	mu     sync.RWMutex
+	people map[int]Person
+	nextID int
+}
+
+// newMemoryStore returns an empty in-memory store whose first ID is 1.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		people: make(map[int]Person),
+		nextID: 1,
+	}
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Person, error) {
+	return s.list(false), nil
+}
+
+func (s *memoryStore) ListDeleted(ctx context.Context) ([]Person, error) {
+	return s.list(true), nil
+}
+
+// list returns either the live people or the tombstones, ordered by ID.
+func (s *memoryStore) list(deleted bool) []Person {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Person, 0, len(s.people))
+	for _, p := range s.people {
+		if (p.DeletedAt != nil) == deleted {
+			list = append(list, p)
+		}
+	}
+	sortPeopleByID(list)
+	return list
+}
+
+// live returns the person with the given ID unless it is missing or
+// deleted. The caller must hold s.mu.
+func (s *memoryStore) live(id int) (Person, bool) {
+	p, ok := s.people[id]
+	return p, ok && p.DeletedAt == nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id int) (Person, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.live(id)
+	if !ok {
+		return Person{}, errPersonNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, p Person) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.ID = s.nextID
+	p.Version = 1
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	s.nextID++
+	s.people[p.ID] = p
+	return p, nil
+}
+
+func (s *memoryStore) CreateMany(ctx context.Context, people []Person) ([]Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	created := make([]Person, len(people))
+	for i, p := range people {
+		p.ID = s.nextID
+		p.Version = 1
+		p.CreatedAt, p.UpdatedAt = now, now
+		s.nextID++
+		s.people[p.ID] = p
+		created[i] = p
+	}
+	return created, nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, id int, apply func(p *Person) error) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.live(id)
+	if !ok {
+		return Person{}, errPersonNotFound
+	}
+
+	err := apply(&p)
+	if err != nil {
+		return Person{}, err
+	}
+
+	// The ID, version, timestamps and deletion mark are owned by the store;
+	// apply may not change them.
+	old := s.people[id]
+	p.ID = id
+	p.Version = old.Version + 1
+	p.CreatedAt = old.CreatedAt
+	p.UpdatedAt = time.Now().UTC()
+	p.DeletedAt = nil
+	s.people[id] = p
+	return p, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id int, check func(p Person) error) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tombstone(id, check)
+}
+
+// tombstone marks a live person as deleted. The caller must hold s.mu.
+func (s *memoryStore) tombstone(id int, check func(p Person) error) (Person, error) {
+	p, ok := s.live(id)
+	if !ok {
+		return Person{}, errPersonNotFound
+	}
+	if check != nil {
+		err := check(p)
+		if err != nil {
+			return Person{}, err
+		}
+	}
+	now := time.Now().UTC()
+	p.DeletedAt = &now
+	p.UpdatedAt = now
+	p.Version++
+	s.people[id] = p
+	return p, nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, id int) (Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.restore(id)
+}
+
+// restore clears the deletion mark of a tombstone. The caller must hold s.mu.
+func (s *memoryStore) restore(id int) (Person, error) {
+	p, ok := s.people[id]
+	if !ok {
+		return Person{}, errPersonNotFound
+	}
+	if p.DeletedAt == nil {
+		return Person{}, errNotDeleted
+	}
+	p.DeletedAt = nil
+	p.UpdatedAt = time.Now().UTC()
+	p.Version++
+	s.people[id] = p
+	return p, nil
+}
+
+func (s *memoryStore) Purge(ctx context.Context, cutoff time.Time) ([]Person, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.purge(cutoff), nil
+}
+
+// purge removes the tombstones deleted before cutoff and returns them,
+// ordered by ID. The caller must hold s.mu.
+func (s *memoryStore) purge(cutoff time.Time) []Person {
+	var purged []Person
+	for id, p := range s.people {
+		if p.DeletedAt != nil && p.DeletedAt.Before(cutoff) {
+			purged = append(purged, p)
+			delete(s.people, id)
+		}
+	}
+	sortPeopleByID(purged)
+	return purged
+}
+
+func (s *memoryStore) Check(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
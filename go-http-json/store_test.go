@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeFactories builds a fresh store of every implementation.
+var storeFactories = map[string]func(t *testing.T) PersonStore{
+	"memory": func(t *testing.T) PersonStore { return newMemoryStore() },
+	"file": func(t *testing.T) PersonStore {
+		s, _, err := openFileStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+}
+
+func TestStoreCRUD(t *testing.T) {
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := open(t)
+			defer s.Close()
+
+			p, err := s.Create(ctx, Person{Name: "Alice", Age: 30})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ID != 1 || p.Version != 1 {
+				t.Fatalf("created %+v, want ID 1 version 1", p)
+			}
+
+			p, err = s.Update(ctx, p.ID, func(p *Person) error {
+				p.Age = 31
+				p.Version = 99 // owned by the store
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Age != 31 || p.Version != 2 {
+				t.Fatalf("updated %+v, want age 31 version 2", p)
+			}
+
+			_, err = s.Delete(ctx, p.ID, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = s.Get(ctx, p.ID)
+			if !errors.Is(err, errPersonNotFound) {
+				t.Fatalf("Get after delete: err = %v, want errPersonNotFound", err)
+			}
+			_, err = s.Update(ctx, p.ID, func(*Person) error { return nil })
+			if !errors.Is(err, errPersonNotFound) {
+				t.Fatalf("Update after delete: err = %v, want errPersonNotFound", err)
+			}
+		})
+	}
+}
+
+// TestStoreConcurrentWrites is meant to be run with -race.
+func TestStoreConcurrentWrites(t *testing.T) {
+	const writers = 50
+	for name, open := range storeFactories {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := open(t)
+			defer s.Close()
+
+			counter, err := s.Create(ctx, Person{Name: "Counter", Age: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for range writers {
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					_, err := s.Create(ctx, Person{Name: "Bob", Age: 25})
+					if err != nil {
+						t.Error(err)
+					}
+				}()
+				go func() {
+					defer wg.Done()
+					_, err := s.Update(ctx, counter.ID, func(p *Person) error {
+						p.Age++
+						return nil
+					})
+					if err != nil {
+						t.Error(err)
+					}
+					s.List(ctx)
+				}()
+			}
+			wg.Wait()
+
+			people, err := s.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(people) != writers+1 {
+				t.Fatalf("got %d people, want %d", len(people), writers+1)
+			}
+			seen := make(map[int]bool)
+			for _, p := range people {
+				if seen[p.ID] {
+					t.Fatalf("ID %d handed out twice", p.ID)
+				}
+				seen[p.ID] = true
+			}
+			got, err := s.Get(ctx, counter.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Age != writers+1 || got.Version != writers+1 {
+				t.Fatalf("counter = age %d version %d, want %d for both", got.Age, got.Version, writers+1)
+			}
+		})
+	}
+}
+
+// recordingSink keeps every event it is given.
+type recordingSink struct{ events []changeEvent }
+
+func (r *recordingSink) publish(ev changeEvent) { r.events = append(r.events, ev) }
+
+func TestEventingStoreEvents(t *testing.T) {
+	ctx := context.Background()
+	sink := &recordingSink{}
+	s := newEventingStore(newMemoryStore(), sink)
+
+	p, err := s.Create(ctx, Person{Name: "Bob", Age: 25, Email: "bob@example.com"})
+	if err == nil {
+		_, err = s.Delete(ctx, p.ID, nil)
+	}
+	if err == nil {
+		_, err = s.Purge(ctx, time.Now().Add(time.Second))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		typ         string
+		name, email string
+	}{
+		{eventCreated, "Bob", "bob@example.com"},
+		{eventDeleted, "Bob", "bob@example.com"},
+		// A purge must not copy what it erased into the SSE buffer or webhooks.
+		{eventPurged, "", ""},
+	}
+	if len(sink.events) != len(tests) {
+		t.Fatalf("got %d events, want %d", len(sink.events), len(tests))
+	}
+	for i, tt := range tests {
+		ev := sink.events[i]
+		if ev.Type != tt.typ || ev.Person.ID != p.ID || ev.Person.Name != tt.name || ev.Person.Email != tt.email {
+			t.Errorf("event %d = %s %+v, want %s with name %q and email %q", i, ev.Type, ev.Person, tt.typ, tt.name, tt.email)
+		}
+		if i > 0 && ev.ID <= sink.events[i-1].ID {
+			t.Errorf("event %d has ID %d after %d", i, ev.ID, sink.events[i-1].ID)
+		}
+	}
+	if purged := sink.events[2].Person; purged.Age != 0 || purged.DeletedAt != nil || !purged.CreatedAt.IsZero() {
+		t.Errorf("purge event still carries %+v", purged)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// restorePersonHandler undoes the soft delete of a person.
+func (s *server) restorePersonHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	id, ok := personIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	person, err := s.store.Restore(r.Context(), id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writePerson(w, r, http.StatusOK, person)
+}
+
+// purgeTombstones permanently removes tombstones older than
+// cfg.PurgeRetention, once at start and then every cfg.PurgeInterval, until
+// ctx is done. It closes done when it returns. A zero interval disables it.
+func (s *server) purgeTombstones(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	if s.cfg.PurgeInterval <= 0 {
+		return
+	}
+
+	// Purges show up in events and history as made by "system".
+	ctx = context.WithValue(ctx, principalKey{}, principal{ID: "system"})
+	ticker := time.NewTicker(s.cfg.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := s.store.Purge(ctx, time.Now().Add(-s.cfg.PurgeRetention))
+		if err != nil {
+			slog.Error("purge deleted people", "err", err)
+		} else if len(purged) > 0 {
+			slog.Info("purged deleted people", "count", len(purged))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
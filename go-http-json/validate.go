@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits enforced on request bodies and Person fields. The validate struct
+// tags on Person and the request types repeat them for /openapi.json.
+const (
+	maxBodyBytes  = 1 << 20 // 1 MiB
+	maxNameLength = 100     // in runes
+	minAge        = 1
+	maxAge        = 150
+
+	maxEmailLength   = 254
+	maxTags          = 20
+	maxTagLength     = 32
+	maxAddressLength = 200 // per address line
+)
+
+// phonePattern is an E.164 number: a plus, a country code and up to 15 digits.
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// countryPattern is an ISO 3166-1 alpha-2 code.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// tagPattern allows lowercase slugs such as "vip" or "on-call".
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// namedPatterns are the patterns a validate tag can name with pattern=, so
+// /openapi.json advertises the same expressions the code checks.
+var namedPatterns = map[string]*regexp.Regexp{
+	"phone":   phonePattern,
+	"country": countryPattern,
+	"tag":     tagPattern,
+}
+
+// requestError is a client error found while reading a request body.
+// It carries everything writeRequestError needs to build the problem.
+type requestError struct {
+	status int
+	code   string
+	detail string
+	fields []fieldError
+}
+
+func (e *requestError) Error() string {
+	return e.detail
+}
+
+// writeRequestError writes err as a problem. Errors that are not a
+// *requestError are treated as internal.
+func writeRequestError(w http.ResponseWriter, r *http.Request, err error) {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		writeStoreError(w, r, err)
+		return
+	}
+	p := newProblem(r, reqErr.status, reqErr.code, reqErr.detail)
+	p.Errors = reqErr.fields
+	sendProblem(w, p)
+}
+
+// decodeJSONBody strictly decodes a single JSON object from the request body
+// into dst. It requires a JSON Content-Type, caps the body at maxBodyBytes,
+// and rejects unknown fields and anything after the first value.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst any) error {
+	err := checkJSONContentType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	return decodeStrict(r.Body, dst)
+}
+
+// decodeStrict decodes exactly one JSON value from src into dst, rejecting
+// unknown fields and trailing data. Errors are *requestError values.
+func decodeStrict(src io.Reader, dst any) error {
+	dec := json.NewDecoder(src)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		return jsonDecodeError(err)
+	}
+
+	// A second Decode must hit EOF; anything else is trailing data.
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return jsonDecodeError(err)
+		}
+		return &requestError{
+			status: http.StatusBadRequest,
+			code:   codeInvalidJSON,
+			detail: "request body must contain a single JSON object",
+		}
+	}
+	return nil
+}
+
+// checkJSONContentType accepts application/json and any +json media type.
+func checkJSONContentType(header string) error {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil
+	}
+	return &requestError{
+		status: http.StatusUnsupportedMediaType,
+		code:   codeUnsupportedMediaType,
+		detail: "Content-Type must be application/json",
+	}
+}
+
+// jsonDecodeError turns an encoding/json error into a requestError with a
+// message that points at the problem without echoing Go type names.
+func jsonDecodeError(err error) error {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		maxErr    *http.MaxBytesError
+	)
+
+	switch {
+	case errors.As(err, &maxErr):
+		return &requestError{
+			status: http.StatusRequestEntityTooLarge,
+			code:   codeBodyTooLarge,
+			detail: fmt.Sprintf("request body must not exceed %d bytes", maxErr.Limit),
+		}
+	case errors.Is(err, io.EOF):
+		return &requestError{status: http.StatusBadRequest, code: codeInvalidJSON, detail: "request body must not be empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &requestError{status: http.StatusBadRequest, code: codeInvalidJSON, detail: "request body contains truncated JSON"}
+	case errors.As(err, &syntaxErr):
+		return &requestError{
+			status: http.StatusBadRequest,
+			code:   codeInvalidJSON,
+			detail: fmt.Sprintf("request body has malformed JSON at byte %d", syntaxErr.Offset),
+		}
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return &requestError{status: http.StatusBadRequest, code: codeInvalidJSON, detail: "request body must be a JSON object"}
+		}
+		return &requestError{
+			status: http.StatusBadRequest,
+			code:   codeValidation,
+			detail: "one or more fields are invalid",
+			fields: []fieldError{{
+				Field:   typeErr.Field,
+				Code:    "invalid_type",
+				Message: fmt.Sprintf("%s must be a JSON %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String())),
+			}},
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no typed error for DisallowUnknownFields.
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return &requestError{
+			status: http.StatusBadRequest,
+			code:   codeUnknownField,
+			detail: "request body contains unknown field " + field,
+		}
+	}
+	return &requestError{status: http.StatusBadRequest, code: codeInvalidJSON, detail: "request body is not valid JSON"}
+}
+
+// jsonTypeName maps a Go kind name to the JSON type a client should send.
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "string":
+		return "string"
+	case kind == "bool":
+		return "boolean"
+	case kind == "slice", kind == "array":
+		return "array"
+	}
+	return "object"
+}
+
+// validatePersonInput checks the name and age of a create or update request
+// and returns one fieldError per problem. A nil pointer means the field was
+// not sent, which is only an error when requireAll is set.
+func validatePersonInput(name *string, age *int, requireAll bool) []fieldError {
+	var errs []fieldError
+
+	if name == nil {
+		if requireAll {
+			errs = append(errs, fieldError{Field: "name", Code: "required", Message: "name is required"})
+		}
+	} else {
+		errs = append(errs, validateName(*name)...)
+	}
+
+	if age == nil {
+		if requireAll {
+			errs = append(errs, fieldError{Field: "age", Code: "required", Message: "age is required"})
+		}
+	} else if *age < minAge || *age > maxAge {
+		errs = append(errs, fieldError{
+			Field:   "age",
+			Code:    "out_of_range",
+			Message: fmt.Sprintf("age must be between %d and %d", minAge, maxAge),
+		})
+	}
+
+	return errs
+}
+
+// validateName reports every problem with a name, not just the first.
+func validateName(name string) []fieldError {
+	if strings.TrimSpace(name) == "" {
+		return []fieldError{{Field: "name", Code: "required", Message: "name must not be empty"}}
+	}
+
+	var errs []fieldError
+	if !utf8.ValidString(name) {
+		errs = append(errs, fieldError{Field: "name", Code: "invalid_encoding", Message: "name must be valid UTF-8"})
+	}
+	if utf8.RuneCountInString(name) > maxNameLength {
+		errs = append(errs, fieldError{
+			Field:   "name",
+			Code:    "too_long",
+			Message: fmt.Sprintf("name must be at most %d characters", maxNameLength),
+		})
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		errs = append(errs, fieldError{Field: "name", Code: "invalid_characters", Message: "name must not contain control characters"})
+	}
+	return errs
+}
+
+// validateContact checks the v2 contact fields. As in validatePersonInput,
+// nil means the field was not sent; an empty value clears the field and is
+// always valid.
+func validateContact(email, phone *string, tags *[]string, addr *Address) []fieldError {
+	var errs []fieldError
+
+	if email != nil && *email != "" {
+		a, err := mail.ParseAddress(*email)
+		switch {
+		case len(*email) > maxEmailLength:
+			errs = append(errs, fieldError{Field: "email", Code: "too_long", Message: fmt.Sprintf("email must be at most %d characters", maxEmailLength)})
+		case err != nil || a.Address != *email:
+			errs = append(errs, fieldError{Field: "email", Code: "invalid", Message: "email must be a plain address such as ada@example.com"})
+		}
+	}
+
+	if phone != nil && *phone != "" && !phonePattern.MatchString(*phone) {
+		errs = append(errs, fieldError{Field: "phone", Code: "invalid", Message: "phone must be in E.164 format, such as +442071838750"})
+	}
+
+	if tags != nil {
+		if len(*tags) > maxTags {
+			errs = append(errs, fieldError{Field: "tags", Code: "too_many", Message: fmt.Sprintf("at most %d tags are allowed", maxTags)})
+		}
+		for i, tag := range *tags {
+			field := fmt.Sprintf("tags[%d]", i)
+			switch {
+			case len(tag) > maxTagLength || !tagPattern.MatchString(tag):
+				errs = append(errs, fieldError{Field: field, Code: "invalid", Message: fmt.Sprintf("tags must be 1 to %d lowercase letters, digits, - or _", maxTagLength)})
+			case slices.Contains((*tags)[:i], tag):
+				errs = append(errs, fieldError{Field: field, Code: "duplicate", Message: "tag " + tag + " is listed twice"})
+			}
+		}
+	}
+
+	if addr != nil {
+		lines := []struct{ field, value string }{
+			{"address.street", addr.Street},
+			{"address.city", addr.City},
+			{"address.postal_code", addr.PostalCode},
+		}
+		for _, l := range lines {
+			if utf8.RuneCountInString(l.value) > maxAddressLength {
+				errs = append(errs, fieldError{Field: l.field, Code: "too_long", Message: fmt.Sprintf("%s must be at most %d characters", l.field, maxAddressLength)})
+			} else if strings.IndexFunc(l.value, unicode.IsControl) >= 0 {
+				errs = append(errs, fieldError{Field: l.field, Code: "invalid_characters", Message: l.field + " must not contain control characters"})
+			}
+		}
+		if addr.Country != "" && !countryPattern.MatchString(addr.Country) {
+			errs = append(errs, fieldError{Field: "address.country", Code: "invalid", Message: "address.country must be an ISO 3166-1 alpha-2 code such as GB"})
+		}
+	}
+	return errs
+}
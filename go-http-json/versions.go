@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiVersion selects the representation of people in requests and
+// responses. Both versions share the same store; Person holds the superset
+// and the v1 types below are views of it.
+type apiVersion int
+
+const (
+	apiV1 apiVersion = 1
+	apiV2 apiVersion = 2
+)
+
+// v1DeprecatedAt is when v2 shipped and v1 became deprecated. It is sent in
+// the Deprecation header of every v1 response.
+var v1DeprecatedAt = time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)
+
+// apiVersionKey is the context key of the version a request was routed to.
+type apiVersionKey struct{}
+
+// apiVersionFrom returns the API version of the request. Anything not
+// routed through s.versioned, such as the admin API, gets v1.
+func apiVersionFrom(ctx context.Context) apiVersion {
+	if v, ok := ctx.Value(apiVersionKey{}).(apiVersion); ok {
+		return v
+	}
+	return apiV1
+}
+
+// versioned wraps a people handler for one API version. v1 responses, which
+// includes the unversioned aliases, carry Deprecation and Sunset headers and
+// a Link to the same resource under /v2.
+func (s *server) versioned(v apiVersion, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v == apiV1 {
+			successor := "/v2" + strings.TrimPrefix(r.URL.Path, "/v1")
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(v1DeprecatedAt.Unix(), 10))
+			w.Header().Set("Sunset", s.cfg.V1Sunset.UTC().Format(http.TimeFormat))
+			w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, v)))
+	}
+}
+
+// versionPrefix returns the path prefix the request was routed through:
+// "/v1", "/v2" or "" for the unversioned aliases.
+func versionPrefix(r *http.Request) string {
+	for _, prefix := range []string{"/v1", "/v2"} {
+		if strings.HasPrefix(r.URL.Path, prefix+"/") {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// personV1 is the v1 representation of a person: today's {id,name,age}
+// contract, plus deleted_at on tombstones.
+type personV1 struct {
+	ID        int        `json:"id" validate:"required,readonly,min=1"`
+	Name      string     `json:"name" validate:"required,minlen=1,maxlen=100"`
+	Age       int        `json:"age" validate:"required,min=1,max=150"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" validate:"readonly"`
+}
+
+// personV1Fields are the JSON fields of personV1 that can change, used to
+// trim history diffs for v1 clients.
+var personV1Fields = []string{"name", "age", "deleted_at"}
+
+// toV1 drops the fields v1 does not know about.
+func toV1(p Person) personV1 {
+	return personV1{ID: p.ID, Name: p.Name, Age: p.Age, DeletedAt: p.DeletedAt}
+}
+
+// personView returns p in the representation of version v.
+func personView(v apiVersion, p Person) any {
+	if v == apiV1 {
+		return toV1(p)
+	}
+	return p
+}
+
+// peoplePageV1 is the v1 shape of the JSON list response.
+type peoplePageV1 struct {
+	Data []personV1 `json:"data" validate:"required"`
+	Next string     `json:"next,omitempty"`
+}
+
+// changeEventV1 is a change event with a v1 person.
+type changeEventV1 struct {
+	ID      uint64    `json:"id" validate:"required"`
+	Type    string    `json:"type" validate:"required,enum=created|updated|deleted|restored|purged"`
+	Time    time.Time `json:"time" validate:"required"`
+	Version int       `json:"version" validate:"required"`
+	Actor   string    `json:"actor" validate:"required"`
+	Person  personV1  `json:"person" validate:"required" doc:"The person after the change. For purged events only id is set."`
+}
+
+// eventView returns ev in the representation of version v.
+func eventView(v apiVersion, ev changeEvent) any {
+	if v == apiV1 {
+		return changeEventV1{ID: ev.ID, Type: ev.Type, Time: ev.Time, Version: ev.Version, Actor: ev.Actor, Person: toV1(ev.Person)}
+	}
+	return ev
+}
+
+// revisionV1 is a revision with a v1 person and only the v1 fields in its
+// diff, so a v2-only change shows up with no changes.
+type revisionV1 struct {
+	EventID  uint64        `json:"event_id,omitempty"`
+	PersonID int           `json:"person_id" validate:"required"`
+	Version  int           `json:"version" validate:"required"`
+	Type     string        `json:"type" validate:"required,enum=baseline|created|updated|deleted|restored|purged"`
+	Time     time.Time     `json:"time" validate:"required"`
+	Actor    string        `json:"actor" validate:"required"`
+	Changes  []fieldChange `json:"changes" validate:"required"`
+	Person   *personV1     `json:"person" validate:"required"`
+}
+
+// revisionsView returns revs in the representation of version v.
+func revisionsView(v apiVersion, revs []revision) any {
+	if v != apiV1 {
+		return revs
+	}
+	views := make([]revisionV1, len(revs))
+	for i, rev := range revs {
+		views[i] = revisionV1{
+			EventID:  rev.EventID,
+			PersonID: rev.PersonID,
+			Version:  rev.Version,
+			Type:     rev.Type,
+			Time:     rev.Time,
+			Actor:    rev.Actor,
+			Changes: slices.DeleteFunc(slices.Clone(rev.Changes), func(c fieldChange) bool {
+				return !slices.Contains(personV1Fields, c.Field)
+			}),
+		}
+		if rev.Person != nil {
+			p := toV1(*rev.Person)
+			views[i].Person = &p
+		}
+	}
+	return views
+}
+
+// personCreate is a decoded create request of either version.
+type personCreate interface {
+	validate() []fieldError
+	person() Person
+}
+
+// newPersonCreate returns an empty create request of version v to decode into.
+func newPersonCreate(v apiVersion) personCreate {
+	if v == apiV1 {
+		return &createPersonRequest{}
+	}
+	return &createPersonRequestV2{}
+}
+
+func (req *createPersonRequest) validate() []fieldError {
+	return validatePersonInput(&req.Name, &req.Age, true)
+}
+
+func (req *createPersonRequest) person() Person {
+	return Person{Name: req.Name, Age: req.Age}
+}
+
+// createPersonRequestV2 is the v2 body for creating a person. Everything
+// but name and age is optional.
+type createPersonRequestV2 struct {
+	Name    string   `json:"name" validate:"required,minlen=1,maxlen=100"`
+	Age     int      `json:"age" validate:"required,min=1,max=150"`
+	Email   string   `json:"email" validate:"maxlen=254"`
+	Phone   string   `json:"phone" validate:"pattern=phone"`
+	Tags    []string `json:"tags" validate:"maxitems=20,maxlen=32,pattern=tag"`
+	Address *Address `json:"address"`
+}
+
+func (req *createPersonRequestV2) validate() []fieldError {
+	errs := validatePersonInput(&req.Name, &req.Age, true)
+	return append(errs, validateContact(&req.Email, &req.Phone, &req.Tags, req.Address)...)
+}
+
+func (req *createPersonRequestV2) person() Person {
+	return Person{
+		Name:    req.Name,
+		Age:     req.Age,
+		Email:   req.Email,
+		Phone:   req.Phone,
+		Tags:    req.Tags,
+		Address: req.Address.orNil(),
+	}
+}
+
+// personUpdate is a decoded PUT or PATCH body of either version.
+type personUpdate interface {
+	bodyID() *int
+	validate(put bool) []fieldError
+	// apply copies the sent fields onto p. For PUT, every field of the
+	// version is replaced; fields the version does not have are kept.
+	apply(p *Person, put bool)
+}
+
+// newPersonUpdate returns an empty update request of version v to decode into.
+func newPersonUpdate(v apiVersion) personUpdate {
+	if v == apiV1 {
+		return &updatePersonRequest{}
+	}
+	return &updatePersonRequestV2{}
+}
+
+func (req *updatePersonRequest) bodyID() *int { return req.ID }
+
+func (req *updatePersonRequest) validate(put bool) []fieldError {
+	return validatePersonInput(req.Name, req.Age, put)
+}
+
+func (req *updatePersonRequest) apply(p *Person, put bool) {
+	if req.Name != nil {
+		p.Name = *req.Name
+	}
+	if req.Age != nil {
+		p.Age = *req.Age
+	}
+}
+
+// updatePersonRequestV2 is the v2 body for PUT and PATCH. As in v1, fields
+// are pointers so PATCH can tell a missing field from a zero value. An
+// empty string, an empty tag list or an empty address clears the field.
+type updatePersonRequestV2 struct {
+	ID      *int      `json:"id" validate:"min=1"`
+	Name    *string   `json:"name" validate:"minlen=1,maxlen=100"`
+	Age     *int      `json:"age" validate:"min=1,max=150"`
+	Email   *string   `json:"email" validate:"maxlen=254"`
+	Phone   *string   `json:"phone" validate:"pattern=phone"`
+	Tags    *[]string `json:"tags" validate:"maxitems=20,maxlen=32,pattern=tag"`
+	Address *Address  `json:"address"`
+}
+
+func (req *updatePersonRequestV2) bodyID() *int { return req.ID }
+
+func (req *updatePersonRequestV2) validate(put bool) []fieldError {
+	errs := validatePersonInput(req.Name, req.Age, put)
+	return append(errs, validateContact(req.Email, req.Phone, req.Tags, req.Address)...)
+}
+
+func (req *updatePersonRequestV2) apply(p *Person, put bool) {
+	if req.Name != nil {
+		p.Name = *req.Name
+	}
+	if req.Age != nil {
+		p.Age = *req.Age
+	}
+	if put {
+		p.Email, p.Phone, p.Tags, p.Address = "", "", nil, nil
+	}
+	if req.Email != nil {
+		p.Email = *req.Email
+	}
+	if req.Phone != nil {
+		p.Phone = *req.Phone
+	}
+	if req.Tags != nil {
+		p.Tags = *req.Tags
+	}
+	if req.Address != nil {
+		p.Address = req.Address.orNil()
+	}
+}
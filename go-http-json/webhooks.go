@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhooksFileName holds subscriptions and delivery state in the data dir.
+const webhooksFileName = "webhooks.json"
+
+// Limits of the webhook dispatcher.
+const (
+	webhookWorkers      = 4    // deliveries in flight at once
+	minWebhookSecretLen = 16   // bytes of a client-chosen secret
+	maxDeadLetters      = 1000 // oldest dead letters are discarded beyond this
+	maxPendingPerHook   = 1000 // later events for a webhook go to the dead letters
+
+	// webhookSaveInterval throttles how often the worker saves the state,
+	// so a burst of deliveries costs one write instead of one per delivery.
+	webhookSaveInterval = time.Second
+)
+
+// errWebhookNotFound is returned for an unknown webhook or dead letter ID.
+var errWebhookNotFound = errors.New("webhook not found")
+
+// webhook is a subscription: changes of the listed types are POSTed to URL.
+// An empty Events list means every type.
+type webhook struct {
+	ID        string    `json:"id" validate:"required,readonly"`
+	URL       string    `json:"url" validate:"required"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at" validate:"required,readonly"`
+}
+
+// wants reports whether h subscribes to events of type typ.
+func (h webhook) wants(typ string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, typ)
+}
+
+// webhookDelivery is one event on its way to one webhook.
+type webhookDelivery struct {
+	ID            string      `json:"id" validate:"required"`
+	WebhookID     string      `json:"webhook_id" validate:"required"`
+	Event         changeEvent `json:"event" validate:"required"`
+	Attempts      int         `json:"attempts" validate:"required"`
+	NextAttemptAt time.Time   `json:"next_attempt_at"`
+	LastError     string      `json:"last_error,omitempty"`
+	FailedAt      *time.Time  `json:"failed_at,omitempty"`
+
+	inFlight bool
+}
+
+// webhookState is the on-disk format of the dispatcher.
+type webhookState struct {
+	Webhooks    []webhook          `json:"webhooks"`
+	Pending     []*webhookDelivery `json:"pending"`
+	DeadLetters []*webhookDelivery `json:"dead_letters"`
+}
+
+// webhookDispatcher is a changeSink that queues one delivery per matching
+// webhook and a worker that POSTs them, retrying with exponential backoff.
+// Deliveries that run out of attempts move to a dead-letter list. With a
+// data dir, subscriptions and both queues survive restarts.
+//
+// The state file is never written with mu held: a copy is taken under mu
+// and saved under saveMu, so publish, which runs under the eventing store's
+// lock, never waits for the disk.
+type webhookDispatcher struct {
+	mu          sync.Mutex
+	path        string // empty keeps state in memory only
+	hooks       map[string]webhook
+	pending     []*webhookDelivery
+	deadLetters []*webhookDelivery
+	dirty       bool
+	lastSave    time.Time
+	gen         uint64 // bumped by every snapshot
+
+	saveMu   sync.Mutex
+	savedGen uint64 // generation of the file on disk, guarded by saveMu
+
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	wake    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	started bool
+	done    chan struct{}
+}
+
+// openWebhookDispatcher loads the saved state from cfg.DataDir, if any. The
+// worker does not run until start is called.
+func openWebhookDispatcher(cfg config) (*webhookDispatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &webhookDispatcher{
+		hooks:       make(map[string]webhook),
+		client:      &http.Client{Timeout: cfg.WebhookTimeout},
+		maxAttempts: max(cfg.WebhookMaxAttempts, 1),
+		backoff:     cfg.WebhookBackoff,
+		maxBackoff:  cfg.WebhookMaxBackoff,
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	if cfg.DataDir == "" {
+		return d, nil
+	}
+
+	d.path = filepath.Join(cfg.DataDir, webhooksFileName)
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read webhook state: %w", err)
+	}
+	var state webhookState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", d.path, err)
+	}
+	for _, h := range state.Webhooks {
+		d.hooks[h.ID] = h
+	}
+	d.pending = state.Pending
+	d.deadLetters = state.DeadLetters
+	return d, nil
+}
+
+// publish queues ev for every webhook that wants it. It only touches memory;
+// the worker saves the queue, so a bulk import is not slowed down by a disk
+// write per event.
+//
+// A webhook whose receiver is down would otherwise grow the queue, and the
+// state file, without limit. Once it has maxPendingPerHook deliveries
+// waiting, new ones go straight to the dead letters, from where they can be
+// retried when the receiver is back.
+func (d *webhookDispatcher) publish(ev changeEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var queued map[string]int
+	if len(d.pending) >= maxPendingPerHook {
+		queued = make(map[string]int)
+		for _, del := range d.pending {
+			queued[del.WebhookID]++
+		}
+	}
+
+	now := time.Now()
+	for _, h := range d.hooks {
+		if !h.wants(ev.Type) {
+			continue
+		}
+		del := &webhookDelivery{
+			ID:            randomID(),
+			WebhookID:     h.ID,
+			Event:         ev,
+			NextAttemptAt: now,
+		}
+		d.dirty = true
+		if queued[h.ID] >= maxPendingPerHook {
+			failed := now.UTC()
+			del.FailedAt = &failed
+			del.LastError = fmt.Sprintf("more than %d deliveries pending", maxPendingPerHook)
+			d.deadLetter(del)
+			continue
+		}
+		d.pending = append(d.pending, del)
+	}
+	if d.dirty {
+		d.signal()
+	}
+}
+
+// signal wakes the worker without blocking.
+func (d *webhookDispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// start runs the worker until close is called.
+func (d *webhookDispatcher) start() {
+	d.started = true
+	go d.run()
+}
+
+// close stops the worker, if it was started, cancels deliveries in flight
+// (they stay pending and are retried after a restart) and saves the state.
+func (d *webhookDispatcher) close() error {
+	d.cancel()
+	if d.started {
+		<-d.done
+	}
+	d.workers.Wait()
+
+	d.mu.Lock()
+	state, gen := d.snapshot()
+	d.mu.Unlock()
+	return d.save(state, gen)
+}
+
+// run starts due deliveries, at most webhookWorkers at a time, and sleeps
+// until the next one is due or something changes. Changes are saved at most
+// once per webhookSaveInterval.
+func (d *webhookDispatcher) run() {
+	defer close(d.done)
+	sem := make(chan struct{}, webhookWorkers)
+
+	for {
+		now := time.Now()
+		d.mu.Lock()
+		var state webhookState
+		var gen uint64
+		saveIn := time.Duration(0)
+		if d.dirty {
+			saveIn = d.lastSave.Add(webhookSaveInterval).Sub(now)
+			if saveIn <= 0 {
+				state, gen = d.snapshot()
+				d.lastSave = now
+			}
+		}
+		due, wait := d.takeDue(now, cap(sem)-len(sem))
+		if saveIn > 0 {
+			wait = min(wait, saveIn)
+		}
+		d.mu.Unlock()
+
+		if gen > 0 {
+			err := d.save(state, gen)
+			if err != nil {
+				slog.Error("save webhook state", "err", err)
+				d.mu.Lock()
+				d.dirty = true
+				d.mu.Unlock()
+			}
+		}
+
+		for _, del := range due {
+			sem <- struct{}{}
+			d.workers.Add(1)
+			go func() {
+				defer func() { <-sem; d.workers.Done() }()
+				d.finish(del, d.deliver(del))
+			}()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// takeDue marks up to limit due deliveries as in flight and returns them,
+// along with how long to wait before the next one is due. The caller must
+// hold d.mu.
+func (d *webhookDispatcher) takeDue(now time.Time, limit int) (due []*webhookDelivery, wait time.Duration) {
+	wait = time.Hour
+	for _, del := range d.pending {
+		if del.inFlight {
+			continue
+		}
+		if until := del.NextAttemptAt.Sub(now); until > 0 {
+			wait = min(wait, until)
+			continue
+		}
+		if len(due) == limit {
+			// Try again as soon as a worker is free.
+			wait = min(wait, 50*time.Millisecond)
+			continue
+		}
+		del.inFlight = true
+		due = append(due, del)
+	}
+	return due, wait
+}
+
+// deliver POSTs the event once. The body is the event JSON; the headers
+// carry the delivery ID, event type, a timestamp and
+// X-Webhook-Signature: sha256=HEX(HMAC-SHA256(secret, timestamp + "." + body)),
+// so receivers can verify the sender and reject replays.
+func (d *webhookDispatcher) deliver(del *webhookDelivery) error {
+	d.mu.Lock()
+	h, ok := d.hooks[del.WebhookID]
+	d.mu.Unlock()
+	if !ok {
+		return errWebhookNotFound
+	}
+
+	body, err := json.Marshal(del.Event)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-http-json-webhooks/1")
+	req.Header.Set("X-Webhook-Id", del.ID)
+	req.Header.Set("X-Webhook-Event", del.Event.Type)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(h.Secret, ts, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of timestamp + "." + body.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// finish records the outcome of an attempt: success removes the delivery,
+// failure schedules a retry or moves it to the dead letters.
+func (d *webhookDispatcher) finish(del *webhookDelivery, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	del.inFlight = false
+	d.dirty = true
+	defer d.signal()
+
+	switch {
+	case err == nil || errors.Is(err, errWebhookNotFound):
+		d.removePending(del)
+		return
+	case d.ctx.Err() != nil:
+		// Cancelled by shutdown; this attempt does not count.
+		return
+	}
+
+	del.Attempts++
+	del.LastError = err.Error()
+	if del.Attempts < d.maxAttempts {
+		del.NextAttemptAt = time.Now().Add(d.retryDelay(del.Attempts))
+		return
+	}
+
+	now := time.Now().UTC()
+	del.FailedAt = &now
+	d.removePending(del)
+	d.deadLetter(del)
+	slog.Warn("webhook delivery dead-lettered", "delivery", del.ID, "webhook", del.WebhookID, "attempts", del.Attempts, "err", err)
+}
+
+// retryDelay is backoff * 2^(attempts-1), capped at maxBackoff, with up to
+// 20% random jitter so failing receivers are not hit in lockstep. The shift
+// is only done when the result stays below maxBackoff, so it cannot
+// overflow however many attempts are allowed.
+func (d *webhookDispatcher) retryDelay(attempts int) time.Duration {
+	delay := max(d.maxBackoff, 0)
+	if shift := attempts - 1; d.backoff <= d.maxBackoff>>shift {
+		delay = max(d.backoff<<shift, 0)
+	}
+	return delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+}
+
+// deadLetter adds del to the dead letters, discarding the oldest beyond
+// maxDeadLetters. The caller must hold d.mu.
+func (d *webhookDispatcher) deadLetter(del *webhookDelivery) {
+	d.deadLetters = append(d.deadLetters, del)
+	if len(d.deadLetters) > maxDeadLetters {
+		d.deadLetters = slices.Delete(d.deadLetters, 0, len(d.deadLetters)-maxDeadLetters)
+	}
+}
+
+// removePending drops del from the queue. The caller must hold d.mu.
+func (d *webhookDispatcher) removePending(del *webhookDelivery) {
+	d.pending = slices.DeleteFunc(d.pending, func(p *webhookDelivery) bool { return p == del })
+}
+
+// snapshot copies the state for save and marks it clean. Deliveries are
+// copied because workers change them while the copy is being written. The
+// caller must hold d.mu.
+func (d *webhookDispatcher) snapshot() (webhookState, uint64) {
+	d.dirty = false
+	if d.path == "" {
+		return webhookState{}, 0
+	}
+	d.gen++
+	return webhookState{
+		Webhooks:    d.list(),
+		Pending:     copyDeliveries(d.pending),
+		DeadLetters: copyDeliveries(d.deadLetters),
+	}, d.gen
+}
+
+// copyDeliveries returns copies of dels.
+func copyDeliveries(dels []*webhookDelivery) []*webhookDelivery {
+	copies := make([]*webhookDelivery, len(dels))
+	for i, del := range dels {
+		c := *del
+		copies[i] = &c
+	}
+	return copies
+}
+
+// save writes a snapshot to the state file, unless a newer one is already
+// on disk. It must be called without d.mu held.
+func (d *webhookDispatcher) save(state webhookState, gen uint64) error {
+	if d.path == "" {
+		return nil
+	}
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+
+	if gen <= d.savedGen {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(d.path, data)
+	if err != nil {
+		return err
+	}
+	d.savedGen = gen
+	return nil
+}
+
+// list returns the webhooks ordered by creation. The caller must hold d.mu.
+func (d *webhookDispatcher) list() []webhook {
+	hooks := make([]webhook, 0, len(d.hooks))
+	for _, h := range d.hooks {
+		hooks = append(hooks, h)
+	}
+	slices.SortFunc(hooks, func(a, b webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return hooks
+}
+
+// add stores a new webhook and saves the state right away, so a
+// subscription the client was told about is never lost.
+func (d *webhookDispatcher) add(h webhook) error {
+	d.mu.Lock()
+	d.hooks[h.ID] = h
+	state, gen := d.snapshot()
+	d.mu.Unlock()
+
+	err := d.save(state, gen)
+	if err != nil {
+		d.mu.Lock()
+		delete(d.hooks, h.ID)
+		d.dirty = true
+		d.mu.Unlock()
+	}
+	return err
+}
+
+// remove deletes a webhook and its pending deliveries.
+func (d *webhookDispatcher) remove(id string) error {
+	d.mu.Lock()
+	if _, ok := d.hooks[id]; !ok {
+		d.mu.Unlock()
+		return errWebhookNotFound
+	}
+	delete(d.hooks, id)
+	d.pending = slices.DeleteFunc(d.pending, func(p *webhookDelivery) bool {
+		return p.WebhookID == id && !p.inFlight
+	})
+	state, gen := d.snapshot()
+	d.mu.Unlock()
+
+	return d.save(state, gen)
+}
+
+// retryDeadLetter moves a dead letter back to the queue with fresh attempts.
+func (d *webhookDispatcher) retryDeadLetter(id string) (webhookDelivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := slices.IndexFunc(d.deadLetters, func(p *webhookDelivery) bool { return p.ID == id })
+	if i < 0 {
+		return webhookDelivery{}, errWebhookNotFound
+	}
+	del := d.deadLetters[i]
+	if _, ok := d.hooks[del.WebhookID]; !ok {
+		return webhookDelivery{}, errWebhookNotFound
+	}
+	d.deadLetters = slices.Delete(d.deadLetters, i, i+1)
+	del.Attempts = 0
+	del.FailedAt = nil
+	del.NextAttemptAt = time.Now()
+	d.pending = append(d.pending, del)
+	d.dirty = true
+	d.signal()
+	return *del, nil
+}
+
+// createWebhookRequest is the body of POST /admin/webhooks. Without a
+// secret, one is generated and returned once in the response.
+type createWebhookRequest struct {
+	URL    string   `json:"url" validate:"required"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret" validate:"minlen=16"`
+}
+
+// validateWebhook checks a subscription request.
+func validateWebhook(req createWebhookRequest) []fieldError {
+	var errs []fieldError
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fieldError{Field: "url", Code: "invalid", Message: "url must be an absolute http or https URL"})
+	}
+	for _, typ := range req.Events {
+		if !slices.Contains(changeEventTypes, typ) {
+			errs = append(errs, fieldError{Field: "events", Code: "invalid", Message: fmt.Sprintf("unknown event %q; use one of %s", typ, strings.Join(changeEventTypes, ", "))})
+		}
+	}
+	if req.Secret != "" && len(req.Secret) < minWebhookSecretLen {
+		errs = append(errs, fieldError{Field: "secret", Code: "too_short", Message: fmt.Sprintf("secret must be at least %d characters", minWebhookSecretLen)})
+	}
+	return errs
+}
+
+// webhooksHandler lists (GET) or creates (POST) webhooks.
+func (s *server) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.webhooks.mu.Lock()
+		hooks := s.webhooks.list()
+		s.webhooks.mu.Unlock()
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, r, http.StatusOK, hooks)
+
+	case http.MethodPost:
+		var req createWebhookRequest
+		err := decodeJSONBody(w, r, &req)
+		if err != nil {
+			writeRequestError(w, r, err)
+			return
+		}
+		errs := validateWebhook(req)
+		if len(errs) > 0 {
+			writeValidationProblem(w, r, errs)
+			return
+		}
+
+		h := webhook{
+			ID:        randomID(),
+			URL:       req.URL,
+			Events:    req.Events,
+			Secret:    req.Secret,
+			CreatedAt: time.Now().UTC(),
+		}
+		if h.Secret == "" {
+			h.Secret = randomID() + randomID()
+		}
+		err = s.webhooks.add(h)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		w.Header().Set("Location", "/admin/webhooks/"+h.ID)
+		writeJSON(w, r, http.StatusCreated, h)
+
+	default:
+		writeMethodNotAllowed(w, r, "GET, POST")
+	}
+}
+
+// webhookHandler deletes a webhook.
+func (s *server) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, r, http.MethodDelete)
+		return
+	}
+	err := s.webhooks.remove(r.PathValue("id"))
+	if errors.Is(err, errWebhookNotFound) {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "webhook not found")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deadLettersHandler lists deliveries that ran out of attempts.
+func (s *server) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	s.webhooks.mu.Lock()
+	dead := make([]webhookDelivery, 0, len(s.webhooks.deadLetters))
+	for _, del := range s.webhooks.deadLetters {
+		dead = append(dead, *del)
+	}
+	s.webhooks.mu.Unlock()
+	writeJSON(w, r, http.StatusOK, dead)
+}
+
+// retryDeadLetterHandler queues a dead letter again.
+func (s *server) retryDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	del, err := s.webhooks.retryDeadLetter(r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, "dead letter not found or its webhook was deleted")
+		return
+	}
+	writeJSON(w, r, http.StatusAccepted, del)
+}
+
+// isAdminPath reports whether path belongs to the admin API.
+func isAdminPath(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a local endpoint that checks signatures and answers
+// with the status in fail, or 204 when it is zero.
+type webhookReceiver struct {
+	*httptest.Server
+	secret string
+	fail   atomic.Int32
+	hits   atomic.Int32
+	events chan changeEvent
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{secret: secret, events: make(chan changeEvent, 16)}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + signWebhook(rcv.secret, r.Header.Get("X-Webhook-Timestamp"), body)
+		if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Webhook-Signature"))) {
+			t.Errorf("bad signature %q", r.Header.Get("X-Webhook-Signature"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if status := rcv.fail.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		var ev changeEvent
+		err := json.Unmarshal(body, &ev)
+		if err != nil {
+			t.Errorf("decode event: %v", err)
+		}
+		if got := r.Header.Get("X-Webhook-Event"); got != ev.Type {
+			t.Errorf("X-Webhook-Event = %q, body type %q", got, ev.Type)
+		}
+		rcv.events <- ev
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+// serve sends one request through the full handler chain, as testAdminKey.
+func serve(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testAdminKey)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// subscribe registers rcv for events through the admin API.
+func subscribe(t *testing.T, h http.Handler, rcv *webhookReceiver, events string) {
+	t.Helper()
+	w := serve(t, h, http.MethodPost, "/admin/webhooks", `{"url":"`+rcv.URL+`","secret":"`+rcv.secret+`","events":`+events+`}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create webhook: %d %s", w.Code, w.Body)
+	}
+}
+
+// waitFor polls cond until it is true or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	enableAdmin(t, s)
+	h := s.handler()
+	rcv := newWebhookReceiver(t, "0123456789abcdef-secret")
+	subscribe(t, h, rcv, `["created"]`)
+
+	w := serve(t, h, http.MethodPost, "/v2/people", `{"name":"Eve","age":28}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create person: %d %s", w.Code, w.Body)
+	}
+	// Not subscribed, so it must not be delivered.
+	serve(t, h, http.MethodDelete, "/v2/people/1", "")
+
+	select {
+	case ev := <-rcv.events:
+		if ev.Type != eventCreated || ev.Person.Name != "Eve" || ev.Version != 1 {
+			t.Fatalf("got event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+	select {
+	case ev := <-rcv.events:
+		t.Fatalf("unexpected %s event", ev.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetryAndDeadLetter(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WebhookMaxAttempts = 3
+	cfg.WebhookBackoff = 10 * time.Millisecond
+	cfg.WebhookMaxBackoff = 20 * time.Millisecond
+	s := newTestServer(t, cfg)
+	enableAdmin(t, s)
+	h := s.handler()
+	rcv := newWebhookReceiver(t, "0123456789abcdef-secret")
+	rcv.fail.Store(http.StatusInternalServerError)
+	subscribe(t, h, rcv, `[]`)
+
+	serve(t, h, http.MethodPost, "/v2/people", `{"name":"Eve","age":28}`)
+
+	var dead []webhookDelivery
+	waitFor(t, "dead letter", func() bool {
+		w := serve(t, h, http.MethodGet, "/admin/webhooks/dead-letters", "")
+		json.Unmarshal(w.Body.Bytes(), &dead)
+		return len(dead) == 1
+	})
+	if got := rcv.hits.Load(); got != 3 {
+		t.Fatalf("receiver was called %d times, want 3", got)
+	}
+	if dead[0].Attempts != 3 || dead[0].FailedAt == nil || !strings.Contains(dead[0].LastError, "500") {
+		t.Fatalf("dead letter = %+v", dead[0])
+	}
+
+	rcv.fail.Store(0)
+	w := serve(t, h, http.MethodPost, "/admin/webhooks/dead-letters/"+dead[0].ID+"/retry", "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("retry: %d %s", w.Code, w.Body)
+	}
+	select {
+	case ev := <-rcv.events:
+		if ev.ID != dead[0].Event.ID {
+			t.Fatalf("redelivered event %d, want %d", ev.ID, dead[0].Event.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dead letter was not redelivered")
+	}
+}
+
+func TestWebhookStateSurvivesRestart(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DataDir = t.TempDir()
+	cfg.WebhookBackoff = time.Hour
+	rcv := newWebhookReceiver(t, "0123456789abcdef-secret")
+	rcv.fail.Store(http.StatusServiceUnavailable)
+
+	d, err := openWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.start()
+	err = d.add(webhook{ID: "hook", URL: rcv.URL, Secret: rcv.secret, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.publish(changeEvent{ID: 7, Type: eventCreated, Person: Person{ID: 1, Name: "Eve"}})
+	waitFor(t, "first attempt", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.pending) == 1 && d.pending[0].Attempts == 1
+	})
+	err = d.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = openWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.hooks) != 1 || len(d.pending) != 1 {
+		t.Fatalf("reloaded %d webhooks and %d pending deliveries, want 1 and 1", len(d.hooks), len(d.pending))
+	}
+	if del := d.pending[0]; del.Event.ID != 7 || del.Attempts != 1 {
+		t.Fatalf("reloaded delivery %+v", del)
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	d := &webhookDispatcher{backoff: 5 * time.Second, maxBackoff: time.Hour}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{4, 40 * time.Second},
+		{20, time.Hour},
+		{40, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tt := range tests {
+		got := d.retryDelay(tt.attempts)
+		if got < tt.want || got > tt.want+tt.want/5 {
+			t.Errorf("retryDelay(%d) = %s, want %s plus up to 20%%", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookAdminNeedsAuth(t *testing.T) {
+	s := newTestServer(t, testConfig(t))
+	h := s.handler()
+	rcv := newWebhookReceiver(t, "0123456789abcdef-secret")
+
+	// Auth is off by default, and then nobody may subscribe.
+	w := serve(t, h, http.MethodPost, "/admin/webhooks", `{"url":"`+rcv.URL+`"}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("create webhook without auth: %d %s", w.Code, w.Body)
+	}
+	s.webhooks.mu.Lock()
+	n := len(s.webhooks.hooks)
+	s.webhooks.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d webhooks registered without auth", n)
+	}
+
+	enableAdmin(t, s)
+	subscribe(t, h, rcv, `[]`)
+}
+
+func TestWebhookPendingLimit(t *testing.T) {
+	cfg := testConfig(t)
+	d, err := openWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The worker is not started, so nothing leaves the queue.
+	d.hooks["down"] = webhook{ID: "down", URL: "http://127.0.0.1:1"}
+	d.hooks["picky"] = webhook{ID: "picky", URL: "http://127.0.0.1:1", Events: []string{eventDeleted}}
+
+	for i := range maxPendingPerHook + 5 {
+		d.publish(changeEvent{ID: uint64(i + 1), Type: eventCreated, Person: Person{ID: 1}})
+	}
+	d.publish(changeEvent{ID: maxPendingPerHook + 6, Type: eventDeleted, Person: Person{ID: 1}})
+
+	queued := map[string]int{}
+	for _, del := range d.pending {
+		queued[del.WebhookID]++
+	}
+	tests := []struct {
+		hook         string
+		queued, dead int
+	}{
+		{"down", maxPendingPerHook, 6},
+		{"picky", 1, 0},
+	}
+	for _, tt := range tests {
+		dead := 0
+		for _, del := range d.deadLetters {
+			if del.WebhookID == tt.hook {
+				dead++
+				if del.FailedAt == nil || del.Attempts != 0 {
+					t.Errorf("overflow dead letter %+v", del)
+				}
+			}
+		}
+		if queued[tt.hook] != tt.queued || dead != tt.dead {
+			t.Errorf("%s: %d pending and %d dead letters, want %d and %d", tt.hook, queued[tt.hook], dead, tt.queued, tt.dead)
+		}
+	}
+	if last := d.deadLetters[len(d.deadLetters)-1]; last.Event.ID != maxPendingPerHook+6 {
+		t.Errorf("last dead letter is event %d, want the newest", last.Event.ID)
+	}
+}
+
+func TestWebhookFinish(t *testing.T) {
+	failure := errors.New("receiver answered 500 Internal Server Error")
+	tests := []struct {
+		name         string
+		attempts     int // before this one
+		err          error
+		wantPending  bool
+		wantDead     bool
+		wantAttempts int
+		wantDelay    time.Duration // minimum wait before the next attempt
+	}{
+		{"success", 0, nil, false, false, 0, 0},
+		{"webhook deleted", 1, errWebhookNotFound, false, false, 1, 0},
+		{"first failure", 0, failure, true, false, 1, time.Second},
+		{"third failure", 2, failure, true, false, 3, 4 * time.Second},
+		{"capped backoff", 3, failure, true, false, 4, 5 * time.Second},
+		{"last attempt", 4, failure, false, true, 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &webhookDispatcher{maxAttempts: 5, backoff: time.Second, maxBackoff: 5 * time.Second, wake: make(chan struct{}, 1)}
+			d.ctx, d.cancel = context.WithCancel(t.Context())
+			del := &webhookDelivery{ID: "d", WebhookID: "h", Attempts: tt.attempts, inFlight: true}
+			d.pending = []*webhookDelivery{del}
+
+			before := time.Now()
+			d.finish(del, tt.err)
+
+			if got := len(d.pending) == 1; got != tt.wantPending {
+				t.Errorf("pending = %v, want %v", got, tt.wantPending)
+			}
+			if got := len(d.deadLetters) == 1; got != tt.wantDead {
+				t.Errorf("dead-lettered = %v, want %v", got, tt.wantDead)
+			}
+			if del.Attempts != tt.wantAttempts || del.inFlight {
+				t.Errorf("attempts = %d, in flight %v; want %d, false", del.Attempts, del.inFlight, tt.wantAttempts)
+			}
+			if tt.wantPending {
+				wait := del.NextAttemptAt.Sub(before)
+				if wait < tt.wantDelay || wait > tt.wantDelay+tt.wantDelay/5+time.Second/10 {
+					t.Errorf("next attempt in %s, want %s plus up to 20%%", wait, tt.wantDelay)
+				}
+			}
+			if tt.wantDead && (del.FailedAt == nil || del.LastError != failure.Error()) {
+				t.Errorf("dead letter %+v lacks failed_at or last_error", del)
+			}
+		})
+	}
+}
+
+func TestWebhookShutdownDoesNotCountAttempt(t *testing.T) {
+	d := &webhookDispatcher{maxAttempts: 1, backoff: time.Second, maxBackoff: time.Second, wake: make(chan struct{}, 1)}
+	d.ctx, d.cancel = context.WithCancel(t.Context())
+	del := &webhookDelivery{ID: "d", WebhookID: "h", inFlight: true}
+	d.pending = []*webhookDelivery{del}
+
+	d.cancel()
+	d.finish(del, context.Canceled)
+	if len(d.pending) != 1 || len(d.deadLetters) != 0 || del.Attempts != 0 {
+		t.Fatalf("after shutdown: %d pending, %d dead, %d attempts; want the delivery untouched", len(d.pending), len(d.deadLetters), del.Attempts)
+	}
+}
+
+func TestWebhookDeadLetterLimit(t *testing.T) {
+	d := &webhookDispatcher{}
+	for i := range maxDeadLetters + 10 {
+		d.deadLetter(&webhookDelivery{ID: strconv.Itoa(i)})
+	}
+	if len(d.deadLetters) != maxDeadLetters || d.deadLetters[0].ID != "10" {
+		t.Fatalf("kept %d dead letters starting at %s, want the newest %d", len(d.deadLetters), d.deadLetters[0].ID, maxDeadLetters)
+	}
+}